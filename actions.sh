@@ -17,9 +17,12 @@ case "$1" in
         go run cmd/random/main.go
     ;;
     "isdag")
-        go run cmd/isdag/main.go
+        go run cmd/isdag/main.go "${@:2}"
     ;;
     "isequal")
         go run cmd/isequal/main.go
     ;;
+    "diff")
+        go run cmd/diff/main.go "${@:2}"
+    ;;
 esac
\ No newline at end of file
@@ -2,6 +2,7 @@ package main
 
 import (
 	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
 	"dag-poll/pkg/utils"
 	"flag"
 	"fmt"
@@ -13,17 +14,24 @@ func main() {
 	maxOutDegree := flag.Int("max-out-degree", 5, "maximum out-degree")
 	payloadSize := flag.Int("payload-size", 10, "size of the payload")
 	dist := flag.String("dist", "./.dag/from.json", "path to save the DAG")
+	hash := flag.String("hash", "md5", "hash function of the node IDs: md5, sha256 or blake3")
 
 	flag.Parse()
+	hasher, err := mkdag.HasherByName(*hash)
+	if err != nil {
+		panic(err)
+	}
+
 	config := dag.DAGConfig{
 		NumNodes:     *numNodes,
 		NumSources:   *numSources,
 		RandomDegree: *maxOutDegree,
 		PayloadSize:  *payloadSize,
+		HashPayload:  mkdag.PayloadHashFunc(hasher),
 	}
 
 	d := dag.GenerateRandomDAG(&config)
-	err := d.IsDAG()
+	err = d.IsDAG()
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"dag-poll/pkg/client"
+	mkdag "dag-poll/pkg/merkledag"
+	"dag-poll/pkg/protocol"
+	"dag-poll/pkg/server"
+	"dag-poll/pkg/utils"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+var (
+	fromPath string
+	toPath   string
+	hash     string
+	endpoint string
+	asJSON   bool
+)
+
+func init() {
+	flag.StringVar(&fromPath, "from", "", "path to load the previous DAG, ./.dag/from.json by default, or its root with -observable-endpoint")
+	flag.StringVar(&toPath, "to", "", "path to load the next DAG, ./.dag/to.json by default, or its root with -observable-endpoint, empty for the current one")
+	flag.StringVar(&hash, "hash", "md5", "hash function of the Merkle IDs: md5, sha256 or blake3")
+	flag.StringVar(&endpoint, "observable-endpoint", "", "diff two roots published by the observable instead of two files")
+	flag.BoolVar(&asJSON, "json", false, "print the diff as JSON")
+	flag.Parse()
+}
+
+func main() {
+	var diff *protocol.DiffResponse
+	if endpoint != "" {
+		var err error
+		diff, err = diffRoots(fromPath, toPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if fromPath == "" {
+			fromPath = "./.dag/from.json"
+		}
+		if toPath == "" {
+			toPath = "./.dag/to.json"
+		}
+
+		hasher, err := mkdag.HasherByName(hash)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		prev, err := utils.ReadDAG(fromPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		next, err := utils.ReadDAG(toPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		a := mkdag.GenerateMerkleDAG(prev, hasher, nil)
+		b := mkdag.GenerateMerkleDAG(next, hasher, nil)
+		diff = server.NewDiffResponse(a.RootMerkleID, b.RootMerkleID, mkdag.Diff(a, b))
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(diff); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	fmt.Printf("from: %s\nto:   %s\n", diff.From, diff.To)
+	for _, id := range diff.Added {
+		fmt.Println("+ node  ", id)
+	}
+	for _, id := range diff.Removed {
+		fmt.Println("- node  ", id)
+	}
+	for _, id := range diff.Updated {
+		fmt.Println("~ node  ", id)
+	}
+	for _, edge := range diff.AddedEdges {
+		fmt.Println("+ edge  ", edge.From, "->", edge.To)
+	}
+	for _, edge := range diff.RemovedEdges {
+		fmt.Println("- edge  ", edge.From, "->", edge.To)
+	}
+	for _, source := range diff.AddedSources {
+		fmt.Println("+ source", source.Name, source.PayloadID)
+	}
+	for _, source := range diff.RemovedSources {
+		fmt.Println("- source", source.Name, source.PayloadID)
+	}
+}
+
+// diffRoots asks the observable for the diff between two of its roots, to
+// empty for the current one.
+func diffRoots(from, to string) (*protocol.DiffResponse, error) {
+	if from == "" {
+		return nil, errors.New("-from root required with -observable-endpoint")
+	}
+
+	c, err := client.New(client.Options{Endpoint: endpoint})
+	if err != nil {
+		return nil, err
+	}
+	diff, err := c.Diff(context.Background(), from, to)
+	if errors.Is(err, client.ErrNotFound) {
+		return nil, fmt.Errorf("root not published by %s, or no longer in its history: %w", endpoint, err)
+	}
+	return diff, err
+}
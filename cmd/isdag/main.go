@@ -1,46 +1,78 @@
 package main
 
 import (
+	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
 	"dag-poll/pkg/utils"
 	"flag"
 	"fmt"
+	"log"
+	"os"
 )
 
 var (
 	fromPath string
 	toPath   string
+	hash     string
+	limit    int
 )
 
 func init() {
 	flag.StringVar(&fromPath, "from", "./.dag/from.json", "path to load the DAG")
 	flag.StringVar(&toPath, "to", "./.dag/to.json", "path to load the DAG")
+	flag.StringVar(&hash, "hash", "md5", "hash function of the node IDs: md5, sha256 or blake3")
+	flag.IntVar(&limit, "limit", 20, "max number of problems printed per kind, 0 for all")
 	flag.Parse()
 }
 
 func main() {
-	err := check(fromPath)
+	hasher, err := mkdag.HasherByName(hash)
 	if err != nil {
-		fmt.Println(err)
+		log.Fatal(err)
 	}
-	fmt.Println(fromPath, "is DAG")
 
-	err = check(toPath)
-	if err != nil {
-		fmt.Println(err)
+	ok := true
+	for _, path := range []string{fromPath, toPath} {
+		if !check(path, hasher) {
+			ok = false
+		}
+	}
+	if !ok {
+		os.Exit(1)
 	}
-	fmt.Println(toPath, "is DAG")
 }
 
-func check(path string) error {
+func check(path string, hasher mkdag.Hasher) bool {
 	d, err := utils.ReadDAG(path)
 	if err != nil {
-		return fmt.Errorf("failed to load DAG from %s, err: %s", path, err)
+		fmt.Printf("failed to load DAG from %s, err: %s\n", path, err)
+		return false
 	}
+	d.Config = &dag.DAGConfig{HashPayload: mkdag.PayloadHashFunc(hasher)}
 
-	err = d.IsDAG()
-	if err != nil {
-		return fmt.Errorf("%s is not DAG, err: %s", path, err)
+	problems := d.Validate()
+	if len(problems) == 0 {
+		fmt.Println(path, "is DAG")
+		return true
 	}
 
-	return nil
+	fmt.Printf("%s is not DAG, %d problems\n", path, len(problems))
+	var kinds []dag.ProblemKind
+	printed := make(map[dag.ProblemKind]int)
+	for _, problem := range problems {
+		if printed[problem.Kind] == 0 {
+			kinds = append(kinds, problem.Kind)
+		}
+		printed[problem.Kind]++
+		if limit > 0 && printed[problem.Kind] > limit {
+			continue
+		}
+		fmt.Printf("  - %s: %s\n", problem.Kind, problem.Message)
+	}
+	for _, kind := range kinds {
+		if n := printed[kind]; limit > 0 && n > limit {
+			fmt.Printf("  ... %d more %s\n", n-limit, kind)
+		}
+	}
+	return false
 }
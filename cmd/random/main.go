@@ -1,6 +1,8 @@
 package main
 
 import (
+	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
 	"dag-poll/pkg/utils"
 	"flag"
 	"fmt"
@@ -10,18 +12,26 @@ import (
 
 var (
 	path string
+	hash string
 )
 
 func init() {
 	flag.StringVar(&path, "path", "./.dag/from.json", "path to load the DAG")
+	flag.StringVar(&hash, "hash", "md5", "hash function of the node IDs: md5, sha256 or blake3")
 	flag.Parse()
 }
 
 func main() {
+	hasher, err := mkdag.HasherByName(hash)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	d, err := utils.ReadDAG(path)
 	if err != nil {
 		log.Fatal(err)
 	}
+	d.Config = &dag.DAGConfig{HashPayload: mkdag.PayloadHashFunc(hasher)}
 
 	actions := []func(int){
 		func(i int) {
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
 	"dag-poll/pkg/utils"
 	"flag"
 	"fmt"
@@ -9,19 +11,27 @@ import (
 var (
 	times int
 	path  string
+	hash  string
 )
 
 func init() {
 	flag.IntVar(&times, "times", 1, "number of times to random update the DAG")
 	flag.StringVar(&path, "path", "./.dag/from.json", "path to load the DAG")
+	flag.StringVar(&hash, "hash", "md5", "hash function of the node IDs: md5, sha256 or blake3")
 	flag.Parse()
 }
 
 func main() {
+	hasher, err := mkdag.HasherByName(hash)
+	if err != nil {
+		panic(err)
+	}
+
 	d, err := utils.ReadDAG(path)
 	if err != nil {
 		panic(err)
 	}
+	d.Config = &dag.DAGConfig{HashPayload: mkdag.PayloadHashFunc(hasher)}
 
 	d.UpdateRandomNodes(times)
 	err = d.IsDAG()
@@ -1,10 +1,15 @@
 module dag-poll
 
-go 1.20
+go 1.22
 
 require (
 	github.com/fsnotify/fsnotify v1.6.0
+	github.com/klauspost/compress v1.18.0
+	github.com/zeebo/blake3 v0.2.4
 	golang.org/x/sync v0.4.0
 )
 
-require golang.org/x/sys v0.0.0-20220908164124-27713097b956 // indirect
+require (
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
+	golang.org/x/sys v0.0.0-20220908164124-27713097b956 // indirect
+)
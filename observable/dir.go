@@ -0,0 +1,119 @@
+package main
+
+import (
+	"dag-poll/pkg/dag"
+	"dag-poll/pkg/server"
+	"dag-poll/pkg/utils"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDir publishes every *.json DAG in dir to the namespace named after
+// the file, and removes the namespace with the file.
+func watchDir(watcher *fsnotify.Watcher, dir string, ns *server.Namespaces) {
+	// One publisher per namespace, a DAG read while the previous one is being
+	// published replaces any DAG still waiting
+	type publisher struct {
+		pending chan *dag.DAG
+		// Closed once the publisher returned, so a removed namespace is not
+		// published again by a DAG still being published
+		done chan struct{}
+	}
+	publishers := make(map[string]*publisher)
+
+	loadDAG := func(path string) {
+		name, ok := namespaceOf(path)
+		if !ok {
+			return
+		}
+
+		d, err := utils.ReadDAG(path)
+		if err != nil {
+			log.Printf("failed to load DAG from %s, err: %s\n", path, err)
+			return
+		}
+
+		p, ok := publishers[name]
+		if !ok {
+			p = &publisher{pending: make(chan *dag.DAG, 1), done: make(chan struct{})}
+			publishers[name] = p
+			go func() {
+				defer close(p.done)
+				for d := range p.pending {
+					if _, err := ns.Publish(name, d); err != nil {
+						log.Printf("namespace not served: %s, err: %s\n", name, err)
+					}
+				}
+			}()
+		}
+
+		select {
+		case <-p.pending:
+		default:
+		}
+		p.pending <- d
+	}
+
+	removeDAG := func(path string) {
+		name, ok := namespaceOf(path)
+		if !ok {
+			return
+		}
+
+		if p, ok := publishers[name]; ok {
+			select {
+			case <-p.pending:
+			default:
+			}
+			close(p.pending)
+			<-p.done
+			delete(publishers, name)
+		}
+		ns.Remove(name)
+		log.Printf("namespace removed: %s\n", name)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("failed to read %s, err: %s\n", dir, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			loadDAG(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			switch {
+			case event.Has(fsnotify.Create), event.Has(fsnotify.Write):
+				loadDAG(event.Name)
+			case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+				removeDAG(event.Name)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("error:", err)
+		}
+	}
+}
+
+// namespaceOf returns the namespace served from the file at path, false if
+// it is not a DAG file.
+func namespaceOf(path string) (string, bool) {
+	name, ok := strings.CutSuffix(filepath.Base(path), ".json")
+	if !ok || !server.ValidNamespace(name) {
+		return "", false
+	}
+	return name, true
+}
@@ -2,13 +2,12 @@ package main
 
 import (
 	"dag-poll/pkg/dag"
-	"dag-poll/pkg/protocol"
+	"dag-poll/pkg/server"
 	"dag-poll/pkg/utils"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	"sync"
 	"time"
 
 	mkdag "dag-poll/pkg/merkledag"
@@ -16,13 +15,41 @@ import (
 	"github.com/fsnotify/fsnotify"
 )
 
-var (
-	state State
-)
-
 func main() {
 	source := flag.String("path", "./.dag/from.json", "path to load the DAG")
+	dir := flag.String("dir", "", "serve every *.json DAG in the directory as the namespace /ns/{file name without .json}, instead of -path")
 	port := flag.String("port", "3633", "port to listen")
+	historySize := flag.Int("history-size", 10, "number of published MerkleDAGs kept for in-flight syncs")
+	historyTTL := flag.Duration("history-ttl", 10*time.Minute, "drop published MerkleDAGs older than this, the latest is always kept, 0 to disable")
+	hash := flag.String("hash", "md5", "hash function of the Merkle IDs: md5, sha256 or blake3")
+	compressMinSize := flag.Int("compress-min-size", 1024, "responses smaller than this are not compressed, negative to disable compression")
+	compat := flag.Bool("compat", true, "also serve the GET with a JSON body forms of /sources, /query, /payload and /payloads to older observers")
+	versionPath := flag.String("version-file", "", "file persisting the last version published, -path with .version appended by default; with -dir, the directory of the {name}.version files, -dir by default")
+	flag.Parse()
+
+	hasher, err := mkdag.HasherByName(*hash)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := server.Options{
+		Hasher:      hasher,
+		HistorySize: *historySize,
+		HistoryTTL:  *historyTTL,
+
+		CompressMinSize:    *compressMinSize,
+		DisableCompression: *compressMinSize < 0,
+		Compat:             *compat,
+		VersionPath:        *versionPath,
+		Logger:             log.Default(),
+	}
+	if opts.VersionPath == "" {
+		opts.VersionPath = *source + ".version"
+		if *dir != "" {
+			opts.VersionPath = *dir
+		}
+	}
+	addr := "0.0.0.0:" + string(*port)
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -30,18 +57,48 @@ func main() {
 	}
 	defer watcher.Close()
 
+	if *dir != "" {
+		ns := server.NewNamespaces(opts)
+		go watchDir(watcher, *dir, ns)
+
+		err = watcher.Add(*dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println("Listening on addr: " + addr)
+		log.Fatal(http.ListenAndServe(addr, ns))
+	}
+
+	s, err := server.NewServer(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Publish in order, a DAG read while the previous one is being published
+	// replaces any DAG still waiting
+	pending := make(chan *dag.DAG, 1)
 	go func() {
-		abort := make(chan struct{})
-		loadDAG := func() {
-			close(abort)
-			abort = make(chan struct{})
+		for d := range pending {
+			if _, err := s.Publish(d); err != nil {
+				log.Printf("DAG from %s not served, err: %s\n", *source, err)
+			}
+		}
+	}()
 
+	go func() {
+		loadDAG := func() {
 			d, err := utils.ReadDAG(*source)
 			if err != nil {
-				log.Fatalf("failed to load DAG from %s, err: %s\n", *source, err)
+				log.Printf("failed to load DAG from %s, err: %s\n", *source, err)
+				return
 			}
 
-			go state.Apply(d, abort)
+			select {
+			case <-pending:
+			default:
+			}
+			pending <- d
 		}
 
 		loadDAG()
@@ -69,248 +126,6 @@ func main() {
 		log.Fatal(err)
 	}
 
-	http.HandleFunc("/root", root)
-	http.HandleFunc("/sources", sources)
-	http.HandleFunc("/query", query)
-	http.HandleFunc("/payload", payload)
-
-	addr := "0.0.0.0:" + string(*port)
 	fmt.Println("Listening on addr: " + addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
-}
-
-func root(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if r.Method != "GET" {
-		http.Error(w, protocol.Error("Method not allowed"), http.StatusMethodNotAllowed)
-		return
-	}
-
-	root := state.Root()
-	if root == "" {
-		http.Error(w, protocol.Error(`Root not found`), http.StatusNotFound)
-		return
-	}
-
-	version := time.Now().Unix()
-	resp := protocol.RootResponse{
-		ID:      root,
-		Version: version,
-	}
-
-	err := resp.Pipe(w)
-	if err != nil {
-		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
-		return
-	}
-}
-
-func sources(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if r.Method != "GET" {
-		http.Error(w, protocol.Error("Method not allowed"), http.StatusMethodNotAllowed)
-		return
-	}
-
-	var sourceReq protocol.SourceRequest
-	err := sourceReq.Load(r)
-	if err != nil {
-		http.Error(w, protocol.Error("Invalid http.Body"), http.StatusBadRequest)
-		return
-	}
-
-	root := state.Root()
-	if root != sourceReq.ID {
-		msg := fmt.Sprintf("Root not match, current root: %v", root)
-		http.Error(w, protocol.Error(msg), http.StatusNotFound)
-		return
-	}
-
-	sources := state.Sources()
-	if sources == nil {
-		http.Error(w, protocol.Error("Sources not found"), http.StatusNotFound)
-		return
-	}
-
-	v := make([]protocol.Source, len(sources))
-	for index, source := range sources {
-		v[index] = protocol.Source{
-			Name:      source.Name,
-			ID:        source.MerkleID,
-			PayloadID: source.PayloadID,
-		}
-	}
-
-	resp := &protocol.SourcesResponse{
-		Size:    len(sources),
-		Sources: v,
-	}
-
-	if err := resp.Pipe(w); err != nil {
-		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
-		return
-	}
-}
-
-func query(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if r.Method != "GET" {
-		http.Error(w, protocol.Error("Method not allowed"), http.StatusMethodNotAllowed)
-		return
-	}
-
-	var queryReq protocol.QueryRequest
-	err := queryReq.Load(r)
-	if err != nil {
-		http.Error(w, protocol.Error("Invalid http.Body"), http.StatusBadRequest)
-		return
-	}
-
-	v := state.Query(queryReq)
-	m := make(protocol.QueryResponse, len(v))
-	for merkleID, items := range v {
-		m[merkleID] = make([]protocol.QueryItem, len(items))
-		for index, item := range items {
-			m[merkleID][index] = protocol.QueryItem{
-				MerkleID:  item.MerkleID,
-				PayloadID: item.PayloadID,
-			}
-		}
-	}
-
-	err = m.Pipe(w)
-	if err != nil {
-		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
-		return
-	}
-}
-
-func payload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, protocol.Error("Method not allowed"), http.StatusMethodNotAllowed)
-		return
-	}
-
-	var payloadRequest protocol.PayloadRequest
-	err := payloadRequest.Load(r.Body)
-	if err != nil {
-		http.Error(w, protocol.Error("Invalid http.Body"), http.StatusBadRequest)
-		return
-	}
-
-	payload := state.Payload(payloadRequest.PayloadID)
-	if payload == nil {
-		http.Error(w, protocol.Error("Payload not found"), http.StatusNotFound)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	var payloadResponse protocol.PayloadResponse
-	payloadResponse.Payload = *payload
-
-	err = payloadResponse.Pipe(w)
-	if err != nil {
-		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
-		return
-	}
-}
-
-type State struct {
-	rw sync.RWMutex
-	*mkdag.MerkleDAG
-}
-
-func (m *State) Apply(d *dag.DAG, abort chan struct{}) {
-	v := mkdag.GenerateMerkleDAG(d, abort)
-
-	select {
-	case <-abort:
-		return
-	default:
-		m.rw.Lock()
-		defer m.rw.Unlock()
-
-		m.MerkleDAG = v
-		fmt.Println("MerkleDAG loaded, root: ", v.RootMerkleID)
-
-		// For debug
-		d := v.ToDAG()
-		if err := d.IsDAG(); err != nil {
-			fmt.Println("MerkleDAG is not valid, err: ", err)
-			return
-		}
-	}
-}
-
-func (m *State) Root() string {
-	m.rw.RLock()
-	defer m.rw.RUnlock()
-
-	return m.RootMerkleID
-}
-
-type QueryItem struct {
-	MerkleID  string
-	PayloadID string
-}
-
-func (m *State) Query(merkleIDs []string) (r map[string][]QueryItem) {
-	m.rw.RLock()
-	defer m.rw.RUnlock()
-
-	r = make(map[string][]QueryItem, len(merkleIDs))
-	if m.MerkleGraph == nil {
-		return
-	}
-
-	for _, merkleID := range merkleIDs {
-		nodes, ok := m.MerkleGraph[merkleID]
-		if !ok {
-			r[merkleID] = []QueryItem{}
-			continue
-		}
-
-		v := []QueryItem{}
-		for _, node := range nodes {
-			item := QueryItem{
-				MerkleID:  node.MerkleID,
-				PayloadID: node.PayloadID,
-			}
-			v = append(v, item)
-		}
-
-		r[merkleID] = v
-	}
-
-	return
-}
-
-func (s *State) Sources() []mkdag.Source {
-	s.rw.RLock()
-	defer s.rw.RUnlock()
-
-	if len(s.MerkleDAG.Sources) == 0 {
-		return nil
-	}
-
-	return s.MerkleDAG.Sources
-}
-
-func (m *State) Payload(payloadID string) (r *string) {
-	m.rw.RLock()
-	defer m.rw.RUnlock()
-
-	if m.PayloadMap == nil {
-		return
-	}
-
-	payload, ok := m.PayloadMap[payloadID]
-	if !ok {
-		return
-	}
-
-	return &payload
+	log.Fatal(http.ListenAndServe(addr, s))
 }
@@ -1,16 +1,20 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"dag-poll/pkg/client"
 	"dag-poll/pkg/dag"
 	mkdag "dag-poll/pkg/merkledag"
 	"dag-poll/pkg/protocol"
+	"dag-poll/pkg/server"
+	"dag-poll/pkg/store"
 	"dag-poll/pkg/utils"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -18,42 +22,127 @@ var (
 	endpoint string
 	from     string
 	to       string
-	root     string
-	sources  string
-	query    string
-	payload  string
-
-	state State
-	task  Task
+	storeDir string
+
+	timeout       time.Duration
+	retries       int
+	retryDelay    time.Duration
+	failureBudget int
+	binary        bool
+	relayPort     string
+	queryDepth    int
+	haveFPRate    float64
+
+	state      State
+	task       Task
+	localStore *store.Store
+	observable *Mirrors
+	// Re-serves the synced MerkleDAG, nil if not relaying
+	relay *server.Server
 )
 
-func init() {
-	flag.StringVar(&endpoint, "observable-endpoint", "http://127.0.0.1:3633", "observable endpoint")
+// setup parses the flags, and connects to the observable. Not done by init, so
+// the tests set what they need instead.
+func setup() {
+	flag.StringVar(&endpoint, "observable-endpoint", "http://127.0.0.1:3633", "observable endpoint, or a comma separated list of mirrors of the same DAG")
 	flag.StringVar(&from, "from", "./.dag/from.json", "path to load the DAG")
 	flag.StringVar(&to, "to", "./.dag/to.json", "path to save the DAG")
+	flag.StringVar(&storeDir, "store", "./.dag/observer", "directory to persist the synced state, empty to disable")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "timeout of a request to the observable, 0 for none")
+	flag.IntVar(&retries, "retries", 3, "attempts of a request failed with a network error or a 5xx status")
+	flag.DurationVar(&retryDelay, "retry-delay", 100*time.Millisecond, "delay before the first retry of a request, doubled on every next one")
+	flag.BoolVar(&binary, "binary", true, "ask the observable for the binary encoding instead of JSON")
+	flag.IntVar(&failureBudget, "failure-budget", 10, "failed requests tolerated by a task for a root before it gives up until the root changes, a task failed within the budget is resumed with the failures so far")
+	flag.IntVar(&queryDepth, "query-depth", 4, "levels of the MerkleDAG fetched by a single query, more saves round trips on long chains; 1 is used instead when the filter of the local state can not be sent, as it would fetch the subtrees the local state has")
+	flag.Float64Var(&haveFPRate, "have-false-positive-rate", 0.01, "false positive rate of the filter of the Merkle IDs the observer has, sent with a query so the observable leaves out their subtrees")
+	flag.StringVar(&relayPort, "relay-port", "", "re-serve the synced DAG on this port with the API of the observable, for downstream observers, empty to disable")
 	flag.Parse()
 
-	root = endpoint + "/root"
-	sources = endpoint + "/sources"
-	query = endpoint + "/query"
-	payload = endpoint + "/payload"
+	var err error
+	var endpoints []string
+	for _, v := range strings.Split(endpoint, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			endpoints = append(endpoints, v)
+		}
+	}
+	observable, err = NewMirrors(endpoints, client.Options{
+		Timeout: timeout,
+		Binary:  binary,
+		Retry: client.RetryPolicy{
+			MaxAttempts: retries,
+			Delay:       retryDelay,
+			MaxDelay:    5 * time.Second,
+			Jitter:      0.5,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	task.OnDone(onTaskDone)
+
+	if relayPort != "" {
+		relay, err = server.NewServer(server.Options{
+			HistorySize: 10,
+			HistoryTTL:  10 * time.Minute,
+			Compat:      true,
+			Logger:      log.Default(),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 }
 
 func main() {
+	setup()
+	loadStore()
+
+	if relay != nil {
+		go func() {
+			addr := "0.0.0.0:" + relayPort
+			fmt.Println("Relay listening on addr: " + addr)
+			log.Fatal(http.ListenAndServe(addr, relay))
+		}()
+	}
+
+	// Long-poll /root/watch until the observable turns out not to support it.
+	// Mirrors are polled instead, to pick the newest of them.
+	watching := observable.Len() == 1
+	// Last root seen from the observable
+	var since string
+
 	for {
-		resp, err := peekRoot()
+		var resp *protocol.RootResponse
+		var err error
+		// A failed task is resumed without waiting for the root to change
+		resuming := task.IsResumable()
+		if watching && !resuming {
+			resp, err = observable.WatchRoot(context.Background(), since)
+			if errors.Is(err, client.ErrUnsupported) {
+				fmt.Println("Watch root unsupported, fallback to polling")
+				watching = false
+				continue
+			}
+		} else {
+			resp, err = observable.Root(context.Background())
+		}
 		if err != nil {
 			fmt.Println("Peek root failed, err: ", err)
 			time.Sleep(time.Second)
 			continue
 		}
+		since = resp.ID
 
 		rootMerkleID := state.GetRootMerkleID()
 		taskStatus := task.GetTaskStatus()
 		taskRootMerkleID := task.GetRootMerkleID()
-		taskVersion := task.GetTaskVersion()
+
+		hasher, err := mkdag.HasherByName(resp.Hash)
+		if err != nil {
+			fmt.Println("Root not supported, err: ", err)
+			goto next
+		}
 
 		if rootMerkleID == resp.ID {
 			fmt.Printf("Root not changed\n")
@@ -62,13 +151,19 @@ func main() {
 
 		if taskStatus == TaskStatusNone {
 			fmt.Printf("Start initial task\n  - task id: %s\n", resp.ID)
-			task.StartTask(resp.ID, resp.Version)
+			task.StartTask(resp, hasher)
 			goto next
 		}
 
-		if taskRootMerkleID != resp.ID && taskVersion <= resp.Version {
+		if task.IsSupersededBy(resp) {
 			fmt.Printf("Root changed, start new task\n  - root id: %s\n  - task id: %s\n", resp.ID, resp.ID)
-			task.StartTask(resp.ID, resp.Version)
+			task.StartTask(resp, hasher)
+			goto next
+		}
+
+		if resuming && taskRootMerkleID == resp.ID {
+			fmt.Printf("Resume failed task\n  - root id: %s\n", taskRootMerkleID)
+			task.Resume()
 			goto next
 		}
 
@@ -81,140 +176,67 @@ func main() {
 		}
 
 	next:
-		time.Sleep(time.Second)
-	}
-}
-
-func peekRoot() (*protocol.RootResponse, error) {
-	resp, err := http.Get(root)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("root not found")
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("root request failed, status: %v", resp.StatusCode)
-	}
-
-	defer resp.Body.Close()
-
-	var r protocol.RootResponse
-	err = r.Load(resp.Body)
-	if err != nil {
-		return nil, err
+		if !watching || task.IsResumable() {
+			time.Sleep(time.Second)
+		}
 	}
-
-	return &r, nil
 }
 
-func getSources(ctx context.Context, rootMerkleID mkdag.MerkleID) (*protocol.SourcesResponse, error) {
-	v := protocol.SourceRequest{ID: rootMerkleID}
-	b, err := json.Marshal(v)
-	if err != nil {
-		panic(err)
+// Resume from the state persisted by a previous run, so the first task only
+// fetches what changed since.
+func loadStore() {
+	if storeDir == "" {
+		return
 	}
 
-	r := bytes.NewReader(b)
-
-	req, err := http.NewRequest(http.MethodGet, sources, r)
+	var err error
+	localStore, err = store.Open(storeDir)
 	if err != nil {
-		return nil, err
+		fmt.Println("Failed to open store, err: ", err)
+		return
 	}
-	req = req.WithContext(ctx)
 
-	resp, err := http.DefaultClient.Do(req)
+	m, missing, err := localStore.Load()
 	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("sources not found, root_id: %v", rootMerkleID)
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("sources request failed, status: %v", resp.StatusCode)
+		fmt.Println("Failed to load store, start from scratch, err: ", err)
+		return
 	}
-
-	defer resp.Body.Close()
-	var sources protocol.SourcesResponse
-	err = sources.Load(resp.Body)
-	if err != nil {
-		return nil, err
+	if m == nil {
+		return
 	}
 
-	return &sources, nil
-}
-
-func doQuery(ctx context.Context, merkleIDs []mkdag.MerkleID) (*protocol.QueryResponse, error) {
-	v := protocol.QueryRequest(merkleIDs)
-	b, err := json.Marshal(v)
-	if err != nil {
-		return nil, err
+	if err := localStore.Prune(m); err != nil {
+		fmt.Println("Failed to prune store, err: ", err)
 	}
 
-	r := bytes.NewReader(b)
-	req, err := http.NewRequest(http.MethodGet, query, r)
-	if err != nil {
-		return nil, err
-	}
-	req = req.WithContext(ctx)
+	state.rw.Lock()
+	state.setMerkleDAG(m)
+	state.rw.Unlock()
+	fmt.Printf("State loaded from store\n  - root id: %s\n", m.RootMerkleID)
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("query request failed, status: %v", resp.StatusCode)
+	// Invalidated or damaged since the last Save, fetched from the observable
+	// by the first task
+	for _, id := range missing {
+		state.MarkCorrupt("missing", id)
 	}
+	state.invalidate()
 
-	defer resp.Body.Close()
-	var queryResp protocol.QueryResponse
-	err = queryResp.Load(resp.Body)
-	if err != nil {
-		return nil, err
+	if relay != nil {
+		relay.PublishMerkle(m)
 	}
-
-	return &queryResp, nil
 }
 
-func getPayload(ctx context.Context, payloadID mkdag.PayloadID) (*protocol.PayloadResponse, error) {
-	v := protocol.PayloadRequest{PayloadID: payloadID}
-	b, err := json.Marshal(v)
-	if err != nil {
-		return nil, err
-	}
-
-	r := bytes.NewReader(b)
-	req, err := http.NewRequest(http.MethodGet, payload, r)
-	if err != nil {
-		return nil, err
-	}
-	req = req.WithContext(ctx)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("payload not found, payload_id: %v", payloadID)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("payload request failed, status: %v", resp.StatusCode)
+func onTaskDone(m *mkdag.MerkleDAG) {
+	if localStore != nil {
+		if err := localStore.Save(m); err != nil {
+			fmt.Println("Failed to save store, err: ", err)
+		}
 	}
 
-	defer resp.Body.Close()
-
-	var payloadResp protocol.PayloadResponse
-	err = payloadResp.Load(resp.Body)
-	if err != nil {
-		return nil, err
+	if relay != nil {
+		relay.PublishMerkle(m)
 	}
 
-	return &payloadResp, nil
-}
-
-func onTaskDone(m *mkdag.MerkleDAG) {
 	d := m.ToDAG()
 
 	if err := d.IsDAG(); err != nil {
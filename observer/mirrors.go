@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"dag-poll/pkg/client"
+	"dag-poll/pkg/protocol"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A mirror failed with a network error or a 5xx status is tried last for this
+// long
+const mirrorDownTime = 10 * time.Second
+
+// Mirrors are observables serving the same DAG. Requests are spread over the
+// healthy ones and fail over to the next one.
+type Mirrors struct {
+	mirrors []*mirror
+	// Round robin over the mirrors
+	next atomic.Uint64
+}
+
+type mirror struct {
+	endpoint string
+	client   *client.Client
+	// Unix nanoseconds until which the mirror is considered down
+	downUntil atomic.Int64
+}
+
+func NewMirrors(endpoints []string, opts client.Options) (*Mirrors, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("no observable endpoint")
+	}
+
+	m := &Mirrors{}
+	for _, endpoint := range endpoints {
+		opts.Endpoint = endpoint
+		c, err := client.New(opts)
+		if err != nil {
+			return nil, err
+		}
+		m.mirrors = append(m.mirrors, &mirror{endpoint: endpoint, client: c})
+	}
+	return m, nil
+}
+
+func (m *mirror) healthy() bool {
+	return time.Now().UnixNano() >= m.downUntil.Load()
+}
+
+func (m *mirror) markDown(err error) {
+	if m.healthy() {
+		fmt.Printf("Mirror down, fail over\n  - endpoint: %s\n  - err: %s\n", m.endpoint, err)
+	}
+	m.downUntil.Store(time.Now().Add(mirrorDownTime).UnixNano())
+}
+
+func (m *mirror) markUp() {
+	m.downUntil.Store(0)
+}
+
+// Len is the number of mirrors.
+func (m *Mirrors) Len() int {
+	return len(m.mirrors)
+}
+
+// order returns the mirrors in the order to try them: the healthy ones from
+// the next in turn, then the ones down in case they are back.
+func (m *Mirrors) order() []*mirror {
+	start := int(m.next.Add(1) % uint64(len(m.mirrors)))
+
+	r := make([]*mirror, 0, len(m.mirrors))
+	var down []*mirror
+	for i := range m.mirrors {
+		v := m.mirrors[(start+i)%len(m.mirrors)]
+		if v.healthy() {
+			r = append(r, v)
+		} else {
+			down = append(down, v)
+		}
+	}
+	return append(r, down...)
+}
+
+// failed is true if err is the mirror failing rather than it not having what
+// is asked for.
+func failed(err error) bool {
+	return !errors.Is(err, client.ErrNotFound) && !errors.Is(err, client.ErrUnsupported)
+}
+
+// try calls f with the mirrors in order until one succeeds. Returns the error
+// of a failed mirror over a not found one, so the request is retried later.
+func try[T any](ctx context.Context, m *Mirrors, f func(*client.Client) (T, error)) (T, error) {
+	var zero T
+	var lastErr, failedErr error
+	for _, v := range m.order() {
+		r, err := f(v.client)
+		if err == nil {
+			v.markUp()
+			return r, nil
+		}
+		if ctx.Err() != nil {
+			return zero, err
+		}
+
+		if failed(err) {
+			v.markDown(err)
+			failedErr = err
+		}
+		lastErr = err
+	}
+
+	if failedErr != nil {
+		return zero, failedErr
+	}
+	return zero, lastErr
+}
+
+// Root asks every mirror for its root and returns the newest one, the first
+// mirror's on a tie.
+func (m *Mirrors) Root(ctx context.Context) (*protocol.RootResponse, error) {
+	resps := make([]*protocol.RootResponse, len(m.mirrors))
+	errs := make([]error, len(m.mirrors))
+
+	var wg sync.WaitGroup
+	for i, v := range m.mirrors {
+		wg.Add(1)
+		go func(i int, v *mirror) {
+			defer wg.Done()
+			resps[i], errs[i] = v.client.Root(ctx)
+			if errs[i] == nil {
+				v.markUp()
+			} else if failed(errs[i]) && ctx.Err() == nil {
+				v.markDown(errs[i])
+			}
+		}(i, v)
+	}
+	wg.Wait()
+
+	var newest *protocol.RootResponse
+	for _, resp := range resps {
+		if resp != nil && (newest == nil || m.newer(resp, newest)) {
+			newest = resp
+		}
+	}
+	if newest == nil {
+		return nil, errors.Join(errs...)
+	}
+	return newest, nil
+}
+
+// newer is true if root is newer than other. The Versions of a single
+// observable, or of the relays of it, which keep its Versions, are in order
+// whatever its clock does. Mirrors publishing the DAG on their own number
+// their own Versions, so their roots are ranked by the Unix time the Version
+// was assigned at first, and by Version within the same second.
+func (m *Mirrors) newer(root, other *protocol.RootResponse) bool {
+	if len(m.mirrors) > 1 && root.Timestamp != other.Timestamp {
+		return root.Timestamp > other.Timestamp
+	}
+	return root.Version > other.Version
+}
+
+// WatchRoot long-polls the first mirror, only meant for a single one.
+func (m *Mirrors) WatchRoot(ctx context.Context, since string) (*protocol.RootResponse, error) {
+	return m.mirrors[0].client.WatchRoot(ctx, since)
+}
+
+func (m *Mirrors) Sources(ctx context.Context, rootMerkleID string) (*protocol.SourcesResponse, error) {
+	return try(ctx, m, func(c *client.Client) (*protocol.SourcesResponse, error) {
+		return c.Sources(ctx, rootMerkleID)
+	})
+}
+
+func (m *Mirrors) QueryTree(ctx context.Context, rootMerkleID string, depth int, req protocol.QueryTreeRequest) (protocol.QueryResponse, error) {
+	return try(ctx, m, func(c *client.Client) (protocol.QueryResponse, error) {
+		return c.QueryTree(ctx, rootMerkleID, depth, req)
+	})
+}
+
+func (m *Mirrors) Payload(ctx context.Context, rootMerkleID string, payloadID string) (*protocol.PayloadResponse, error) {
+	return try(ctx, m, func(c *client.Client) (*protocol.PayloadResponse, error) {
+		return c.Payload(ctx, rootMerkleID, payloadID)
+	})
+}
+
+func (m *Mirrors) Payloads(ctx context.Context, rootMerkleID string, payloadIDs []string) (*protocol.PayloadsResponse, error) {
+	return try(ctx, m, func(c *client.Client) (*protocol.PayloadsResponse, error) {
+		return c.Payloads(ctx, rootMerkleID, payloadIDs)
+	})
+}
+
+func (m *Mirrors) Delta(ctx context.Context, from string, to string) (*protocol.DeltaResponse, error) {
+	return try(ctx, m, func(c *client.Client) (*protocol.DeltaResponse, error) {
+		return c.Delta(ctx, from, to)
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"dag-poll/pkg/client"
+	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
+	"dag-poll/pkg/protocol"
+	"dag-poll/pkg/server"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reset starts a test from an empty local state, with the default flags.
+func reset(t *testing.T) {
+	t.Helper()
+
+	state = State{}
+	task = Task{}
+	localStore = nil
+	relay = nil
+	failureBudget = 10
+	queryDepth = 4
+	haveFPRate = 0.01
+}
+
+func newServer(t *testing.T) *server.Server {
+	t.Helper()
+
+	s, err := server.NewServer(server.Options{HistorySize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newObservable(t *testing.T) (*server.Server, *httptest.Server) {
+	t.Helper()
+
+	s := newServer(t)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func publish(t *testing.T, s *server.Server, d *dag.DAG) *mkdag.MerkleDAG {
+	t.Helper()
+
+	m, err := s.Publish(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func newMirrors(t *testing.T, endpoints ...string) *Mirrors {
+	t.Helper()
+
+	m, err := NewMirrors(endpoints, client.Options{
+		Timeout: 5 * time.Second,
+		Retry:   client.RetryPolicy{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMirrorsFailover(t *testing.T) {
+	ctx := context.Background()
+	s, good := newObservable(t)
+	m := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+
+	var calls atomic.Int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, protocol.Error("Unavailable"), http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(bad.Close)
+
+	mirrors := newMirrors(t, bad.URL, good.URL)
+	for i := 0; i < 4; i++ {
+		resp, err := mirrors.Sources(ctx, m.RootMerkleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Size != len(m.Sources) {
+			t.Fatalf("len(sources) not match, expected: %d, actual: %d", len(m.Sources), resp.Size)
+		}
+	}
+
+	// Tried last while down, the healthy mirror answers first
+	if calls.Load() != 1 {
+		t.Errorf("failed mirror not tried last, calls: %d", calls.Load())
+	}
+	if order := mirrors.order(); order[len(order)-1] != mirrors.mirrors[0] {
+		t.Errorf("failed mirror not ordered last")
+	}
+}
+
+func TestMirrorsLagging(t *testing.T) {
+	reset(t)
+	ctx := context.Background()
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	lagging, laggingTS := newObservable(t)
+	ahead, aheadTS := newObservable(t)
+	publish(t, lagging, d)
+	publish(t, ahead, d)
+
+	next := d.Clone()
+	next.UpdateRandomNodes(10)
+	m := publish(t, ahead, next)
+
+	observable = newMirrors(t, laggingTS.URL, aheadTS.URL)
+	resp, err := observable.Root(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != m.RootMerkleID {
+		t.Fatalf("newest root not picked, expected: %s, actual: %s", m.RootMerkleID, resp.ID)
+	}
+
+	// The lagging mirror does not have the root, the task fails over to the
+	// other one
+	task.StartTask(resp, mkdag.DefaultHasher)
+	if status := task.GetTaskStatus(); status != TaskStatusDone {
+		t.Fatalf("task not done, status: %s", status)
+	}
+	if state.GetRootMerkleID() != m.RootMerkleID {
+		t.Fatalf("root not synced")
+	}
+
+	// Not back to the older root of the lagging mirror
+	old, err := newMirrors(t, laggingTS.URL).Root(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.IsSupersededBy(old) {
+		t.Errorf("older root of a lagging mirror supersedes the task")
+	}
+	if !task.IsSupersededBy(&protocol.RootResponse{ID: "newer", Version: resp.Version + 1, Timestamp: resp.Timestamp}) {
+		t.Errorf("newer root does not supersede the task")
+	}
+}
+
+func TestMirrorsNewer(t *testing.T) {
+	reset(t)
+
+	older := &protocol.RootResponse{ID: "older", Version: 2, Timestamp: 200}
+	// The clock of the observable went back in between
+	newer := &protocol.RootResponse{ID: "newer", Version: 3, Timestamp: 100}
+
+	observable = newMirrors(t, "http://127.0.0.1:1")
+	if !observable.newer(newer, older) || observable.newer(older, newer) {
+		t.Errorf("Versions of a single observable not in order")
+	}
+	task.merkleDAG = &mkdag.MerkleDAG{RootMerkleID: older.ID, Version: older.Version, Timestamp: older.Timestamp}
+	if !task.IsSupersededBy(newer) {
+		t.Errorf("newer Version does not supersede the task")
+	}
+
+	// Mirrors number their own Versions
+	mirrors := newMirrors(t, "http://127.0.0.1:1", "http://127.0.0.1:2")
+	if !mirrors.newer(older, newer) || mirrors.newer(newer, older) {
+		t.Errorf("roots of mirrors not ranked by timestamp")
+	}
+}
@@ -2,12 +2,29 @@ package main
 
 import (
 	mkdag "dag-poll/pkg/merkledag"
+	"dag-poll/pkg/protocol"
+	"dag-poll/pkg/utils"
+	"fmt"
 	"sync"
 )
 
 type State struct {
 	rw sync.RWMutex
 	*mkdag.MerkleDAG
+
+	mu sync.Mutex
+	// Entries of the MerkleDAG found inconsistent, fetched from the
+	// observable instead
+	corrupt utils.Set[string]
+	// Corrupt entries found since start
+	corruptCount int
+	// Corrupt entries not dropped from the store yet
+	invalid []string
+
+	// PayloadIDs of the MerkleIDs of the MerkleDAG, as paired by the sources
+	// and the edges of their parents, built on first use
+	pairingOnce *sync.Once
+	pairing     map[mkdag.MerkleID]mkdag.PayloadID
 }
 
 func (s *State) GetRootMerkleID() string {
@@ -22,13 +39,115 @@ func (s *State) GetRootMerkleID() string {
 }
 
 func (s *State) GetPayload(payloadID mkdag.PayloadID) (r mkdag.Payload, ok bool) {
+	// Deferred first, so run after s.rw is released
+	defer s.invalidate()
 	s.rw.RLock()
 	defer s.rw.RUnlock()
 
-	if s.MerkleDAG == nil {
+	if s.MerkleDAG == nil || s.isCorrupt(payloadID) {
 		return "", false
 	}
 
-	r, ok = s.PayloadMap[payloadID]
+	r, ok = s.PayloadMap.Get(payloadID)
+	if ok && r == "" {
+		s.MarkCorrupt("payload_id", payloadID)
+		return "", false
+	}
 	return
 }
+
+// HaveFilter returns a BloomFilter of the MerkleIDs of the state, leaving out
+// the corrupt ones, nil if there are none.
+func (s *State) HaveFilter(falsePositiveRate float64) *protocol.BloomFilter {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+
+	if s.MerkleDAG == nil || s.MerkleGraph.Len() == 0 {
+		return nil
+	}
+
+	f := protocol.NewBloomFilter(s.MerkleGraph.Len(), falsePositiveRate)
+	s.MerkleGraph.Range(func(merkleID mkdag.MerkleID, _ []*mkdag.Node) bool {
+		if !s.isCorrupt(merkleID) {
+			f.Add(merkleID)
+		}
+		return true
+	})
+	return f
+}
+
+// MarkCorrupt stops the entry of the MerkleDAG from being used. The next
+// invalidate drops it from the store, so the copy fetched from the observable
+// is saved instead.
+func (s *State) MarkCorrupt(kind string, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.corrupt.Contains(id) {
+		return
+	}
+	if s.corrupt == nil {
+		s.corrupt = make(utils.Set[string])
+	}
+	s.corrupt.Add(id)
+	s.corruptCount++
+	s.invalid = append(s.invalid, id)
+
+	fmt.Printf("Warning: corrupt local entry, fetch from observable\n  - %s: %s\n  - corrupt entries: %d\n", kind, id, s.corruptCount)
+}
+
+// invalidate drops the entries marked corrupt from the store. It waits for
+// the disk, so must not be called with s.rw or the locks of a task held.
+func (s *State) invalidate() {
+	s.mu.Lock()
+	invalid := s.invalid
+	s.invalid = nil
+	s.mu.Unlock()
+
+	if localStore == nil {
+		return
+	}
+	for _, id := range invalid {
+		if err := localStore.Invalidate(id); err != nil {
+			fmt.Println("Failed to invalidate store entry, err: ", err)
+		}
+	}
+}
+
+func (s *State) isCorrupt(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.corrupt.Contains(id)
+}
+
+// setMerkleDAG replaces the MerkleDAG, must be called with s.rw held.
+func (s *State) setMerkleDAG(m *mkdag.MerkleDAG) {
+	s.MerkleDAG = m
+	s.pairingOnce = new(sync.Once)
+	s.pairing = nil
+
+	s.mu.Lock()
+	s.corrupt = nil
+	s.mu.Unlock()
+}
+
+// payloadIDOf returns the PayloadID the MerkleDAG pairs the MerkleID with,
+// must be called with s.rw held.
+func (s *State) payloadIDOf(merkleID mkdag.MerkleID) (mkdag.PayloadID, bool) {
+	s.pairingOnce.Do(func() {
+		s.pairing = make(map[mkdag.MerkleID]mkdag.PayloadID, s.MerkleGraph.Len())
+		for _, source := range s.Sources {
+			s.pairing[source.MerkleID] = source.PayloadID
+		}
+		s.MerkleGraph.Range(func(_ mkdag.MerkleID, edges []*mkdag.Node) bool {
+			for _, edge := range edges {
+				s.pairing[edge.MerkleID] = edge.PayloadID
+			}
+			return true
+		})
+	})
+
+	payloadID, ok := s.pairing[merkleID]
+	return payloadID, ok
+}
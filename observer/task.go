@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"dag-poll/pkg/client"
 	mkdag "dag-poll/pkg/merkledag"
 	"dag-poll/pkg/protocol"
 	"dag-poll/pkg/utils"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -20,11 +22,37 @@ type Task struct {
 
 	visitedMerkleIDs  utils.Set[mkdag.MerkleID]
 	visitedPayloadIDs utils.Set[mkdag.PayloadID]
+	// PayloadIDs the MerkleIDs were verified or migrated with. The MerkleID
+	// of a parent does not cover the PayloadIDs of its children, a child
+	// seen again must come with the same PayloadID.
+	pairing map[mkdag.MerkleID]mkdag.PayloadID
 
 	wg sync.WaitGroup
 
 	sem *semaphore.Weighted
 
+	// Failed requests since the root was set, kept across resumes
+	failures int
+	// Work of the failed requests, redone by Resume
+	pendingSources  bool
+	pendingQueries  []protocol.QueryItem
+	pendingPayloads []mkdag.PayloadID
+	// False once the task failed for a reason a retry does not fix, e.g. a
+	// verification error, or exhausted the failure budget
+	resumable bool
+
+	// Merkle nodes and payloads sent ahead of the walk, by /delta or the
+	// deeper levels of a query, taken by the walk instead of querying the
+	// observable. Verified once taken, as their parent is.
+	prefetchedNodes    protocol.QueryResponse
+	prefetchedPayloads map[mkdag.PayloadID]mkdag.Payload
+	// MerkleIDs of the local state, sent with the queries so the observable
+	// leaves their subtrees out, nil to send none
+	haveFilter *protocol.BloomFilter
+	// Levels fetched by a query, over 1 only while the observable is told
+	// what the local state has
+	depth int
+
 	onDone []func(*mkdag.MerkleDAG)
 }
 
@@ -81,19 +109,32 @@ func (t *Task) GetRootMerkleID() string {
 	return t.merkleDAG.RootMerkleID
 }
 
-func (t *Task) GetTaskVersion() int64 {
+// GetTaskVersion returns the Version of the root of the task, with the
+// Timestamp it was assigned at.
+func (t *Task) GetTaskVersion() (version int64, timestamp int64) {
 	if t == nil {
-		return 0
+		return 0, 0
 	}
 
 	t.rw.RLock()
 	defer t.rw.RUnlock()
 
 	if t.merkleDAG == nil {
-		return 0
+		return 0, 0
 	}
 
-	return t.merkleDAG.Version
+	return t.merkleDAG.Version, t.merkleDAG.Timestamp
+}
+
+// IsSupersededBy is true if root is another root than the one of the task,
+// not older than it. A mirror lagging behind serves an older root, which
+// would take the observer back. Only the Versions are compared with a single
+// observable, its Timestamps go back with its clock; they only rank the roots
+// of mirrors, which number their Versions independently.
+func (t *Task) IsSupersededBy(root *protocol.RootResponse) bool {
+	version, timestamp := t.GetTaskVersion()
+	current := &protocol.RootResponse{Version: version, Timestamp: timestamp}
+	return t.GetRootMerkleID() != root.ID && !observable.newer(current, root)
 }
 
 func (t *Task) Apply() {
@@ -108,7 +149,7 @@ func (t *Task) Apply() {
 		state.rw.Lock()
 		defer state.rw.Unlock()
 
-		state.MerkleDAG = t.merkleDAG
+		state.setMerkleDAG(t.merkleDAG)
 	}
 }
 
@@ -144,6 +185,7 @@ func (t *Task) setFailed(err error) {
 
 	t.cancel()
 	t.status = TaskStatusFailed
+	t.resumable = false
 	fmt.Println("Task failed, err: ", err)
 }
 
@@ -153,13 +195,20 @@ func (t *Task) setDone() {
 
 	t.cancel()
 	t.status = TaskStatusDone
+	t.prefetchedNodes = nil
+	t.prefetchedPayloads = nil
+	t.haveFilter = nil
 }
 
-func (t *Task) isVisitedMerkleID(merkleID mkdag.MerkleID) bool {
+// visitedPayloadID returns the PayloadID of the MerkleID if it was visited.
+func (t *Task) visitedPayloadID(merkleID mkdag.MerkleID) (payloadID mkdag.PayloadID, ok bool) {
 	t.rw.RLock()
 	defer t.rw.RUnlock()
 
-	return t.visitedMerkleIDs.Contains(merkleID)
+	if !t.visitedMerkleIDs.Contains(merkleID) {
+		return "", false
+	}
+	return t.pairing[merkleID], true
 }
 
 func (t *Task) isVisitedPayloadID(payloadID mkdag.PayloadID) bool {
@@ -174,49 +223,68 @@ func (t *Task) setMerkleGraph(id mkdag.MerkleID, edges []*mkdag.Node) {
 	defer t.rw.Unlock()
 
 	t.visitedMerkleIDs.Add(id)
-	t.merkleDAG.MerkleGraph[id] = edges
+	t.merkleDAG.MerkleGraph.Set(id, edges)
 }
 
-func (t *Task) migrate(merkleID mkdag.MerkleID, payloadID mkdag.PayloadID) bool {
+// migrate copies the subtree of merkleID from the local state, ok is false if
+// the local state does not have it. Nodes of the subtree the local state is
+// inconsistent about are marked corrupt and returned to be fetched from the
+// observable instead. err is not nil if the local state pairs merkleID with
+// another PayloadID.
+func (t *Task) migrate(merkleID mkdag.MerkleID, payloadID mkdag.PayloadID) (ok bool, fetchList []protocol.QueryItem, err error) {
 	state.rw.RLock()
 	defer state.rw.RUnlock()
 
-	if state.MerkleDAG == nil {
-		return false
+	if state.MerkleDAG == nil || state.isCorrupt(merkleID) {
+		return false, nil, nil
 	}
 
-	_, ok := state.MerkleGraph[merkleID]
+	if !state.MerkleGraph.Has(merkleID) {
+		return false, nil, nil
+	}
+
+	localPayloadID, ok := state.payloadIDOf(merkleID)
 	if !ok {
-		return false
+		// Not referenced by the local graph, so not verified either
+		return false, nil, nil
+	}
+	if localPayloadID != payloadID {
+		return false, nil, pairingError(merkleID, payloadID, localPayloadID)
 	}
 
 	t.rw.Lock()
 	defer t.rw.Unlock()
 
+	fetch := make(utils.Set[mkdag.MerkleID])
 	var f func(mkdag.MerkleID, mkdag.PayloadID)
 	f = func(merkleID mkdag.MerkleID, payloadID mkdag.PayloadID) {
-		if t.visitedMerkleIDs.Contains(merkleID) {
+		if t.visitedMerkleIDs.Contains(merkleID) || fetch.Contains(merkleID) {
 			return
 		}
 
-		// fmt.Println(len(state.merkleGraph))
-		edges, ok := state.MerkleGraph[merkleID]
-		if !ok {
-			// TODO
-			panic("merkleID not found")
+		edges, ok := state.MerkleGraph.Get(merkleID)
+		if !ok || state.isCorrupt(merkleID) {
+			// Referenced by its parent, so it must be there
+			state.MarkCorrupt("merkle_id", merkleID)
+			fetch.Add(merkleID)
+			fetchList = append(fetchList, protocol.QueryItem{MerkleID: merkleID, PayloadID: payloadID})
+			return
 		}
 
-		payload, ok := state.PayloadMap[payloadID]
-		if !ok {
-			// TODO
-			panic("payloadID not found")
+		payload, ok := state.PayloadMap.Get(payloadID)
+		if !ok || payload == "" || state.isCorrupt(payloadID) {
+			state.MarkCorrupt("payload_id", payloadID)
+			fetch.Add(merkleID)
+			fetchList = append(fetchList, protocol.QueryItem{MerkleID: merkleID, PayloadID: payloadID})
+			return
 		}
 
 		t.visitedMerkleIDs.Add(merkleID)
-		t.merkleDAG.MerkleGraph[merkleID] = edges
+		t.pairing[merkleID] = payloadID
+		t.merkleDAG.MerkleGraph.Set(merkleID, edges)
 
 		t.visitedPayloadIDs.Add(payloadID)
-		t.merkleDAG.PayloadMap[payloadID] = payload
+		t.merkleDAG.PayloadMap.Set(payloadID, payload)
 
 		for _, edge := range edges {
 			f(edge.MerkleID, edge.PayloadID)
@@ -225,132 +293,263 @@ func (t *Task) migrate(merkleID mkdag.MerkleID, payloadID mkdag.PayloadID) bool
 
 	f(merkleID, payloadID)
 
-	return true
+	return true, fetchList, nil
+}
+
+func pairingError(merkleID mkdag.MerkleID, payloadID, expected mkdag.PayloadID) error {
+	return fmt.Errorf("payload_id does not match the merkle_id, merkle_id: %s, payload_id: %s, expected: %s", merkleID, payloadID, expected)
+}
+
+func (t *Task) getHasher() mkdag.Hasher {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+
+	return t.merkleDAG.Hasher
+}
+
+func (t *Task) getHaveFilter() *protocol.BloomFilter {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+
+	return t.haveFilter
+}
+
+func (t *Task) getDepth() int {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+
+	return t.depth
 }
 
 func (t *Task) getPayload(payloadID mkdag.PayloadID) (mkdag.Payload, bool) {
 	t.rw.RLock()
 	defer t.rw.RUnlock()
 
-	payload, ok := t.merkleDAG.PayloadMap[payloadID]
-	return payload, ok
+	return t.merkleDAG.PayloadMap.Get(payloadID)
 }
 
 func (t *Task) setPayload(payloadID mkdag.PayloadID, payload mkdag.Payload) {
 	t.rw.Lock()
 	defer t.rw.Unlock()
 
-	if payload == "" {
-		// TODO
-		panic("payload is empty")
+	t.visitedPayloadIDs.Add(payloadID)
+	t.merkleDAG.PayloadMap.Set(payloadID, payload)
+}
+
+// prepare resets the task for a new root, dropping the progress of the
+// previous one.
+func (t *Task) prepare(root *protocol.RootResponse, hasher mkdag.Hasher) {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+
+	t.merkleDAG = &mkdag.MerkleDAG{
+		Version:      root.Version,
+		Timestamp:    root.Timestamp,
+		RootMerkleID: root.ID,
+		Hasher:       hasher,
 	}
+	t.visitedMerkleIDs = make(utils.Set[mkdag.MerkleID])
+	t.visitedPayloadIDs = make(utils.Set[mkdag.PayloadID])
+	t.pairing = make(map[mkdag.MerkleID]mkdag.PayloadID)
+	t.resumable = true
+	t.failures = 0
+	t.pendingSources = false
+	t.pendingQueries = nil
+	t.pendingPayloads = nil
+	t.prefetchedNodes = make(protocol.QueryResponse)
+	t.prefetchedPayloads = make(map[mkdag.PayloadID]mkdag.Payload)
+	t.haveFilter = nil
+	t.depth = 1
+}
 
-	t.visitedPayloadIDs.Add(payloadID)
-	t.merkleDAG.PayloadMap[payloadID] = payload
+func (t *Task) StartTask(root *protocol.RootResponse, hasher mkdag.Hasher) {
+	t.setupTask()
+	t.prepare(root, hasher)
+	if queryDepth > 1 {
+		haveFilter := state.HaveFilter(haveFPRate)
+		empty := state.GetRootMerkleID() == ""
+		t.rw.Lock()
+		t.haveFilter = haveFilter
+		if haveFilter != nil || empty {
+			t.depth = queryDepth
+		}
+		t.rw.Unlock()
+	}
+
+	items, ok := t.syncSources()
+	if !ok {
+		t.finish()
+		return
+	}
+	t.syncDelta()
+
+	t.run(items, nil)
 }
 
-func (t *Task) StartTask(rootMerkleID mkdag.MerkleID, version int64) {
+// Resume redoes the failed requests of a resumable task, keeping the graph
+// nodes and payloads fetched so far.
+func (t *Task) Resume() {
 	t.setupTask()
 
-	sourcesResp, err := getSources(t.ctx, rootMerkleID)
+	t.rw.Lock()
+	pendingSources := t.pendingSources
+	queries, payloadIDs := t.pendingQueries, t.pendingPayloads
+	t.pendingSources = false
+	t.pendingQueries = nil
+	t.pendingPayloads = nil
+	t.rw.Unlock()
+
+	if pendingSources {
+		items, ok := t.syncSources()
+		if !ok {
+			t.finish()
+			return
+		}
+		queries = append(queries, items...)
+		t.syncDelta()
+	}
+
+	t.run(queries, payloadIDs)
+}
+
+// IsResumable is true if the task failed on requests which may succeed on
+// retry, and Resume can pick it up.
+func (t *Task) IsResumable() bool {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+
+	return t.status == TaskStatusFailed && t.resumable
+}
+
+// syncSources fetches the sources of the root, returns them as the first
+// items to query, ok is false if the task can not go on.
+func (t *Task) syncSources() (items []protocol.QueryItem, ok bool) {
+	rootMerkleID := t.GetRootMerkleID()
+
+	sourcesResp, err := observable.Sources(t.ctx, rootMerkleID)
 	if err != nil {
-		t.setFailed(err)
-		return
+		t.fail(err, func() {
+			t.pendingSources = true
+		})
+		return nil, false
 	}
 
 	var sources []mkdag.Source
+	var sourceMerkleIDs []mkdag.MerkleID
 	for _, source := range sourcesResp.Sources {
 		sources = append(sources, mkdag.Source{
 			Name:      source.Name,
 			MerkleID:  source.ID,
 			PayloadID: source.PayloadID,
 		})
+		sourceMerkleIDs = append(sourceMerkleIDs, source.ID)
+		items = append(items, protocol.QueryItem{
+			MerkleID:  source.ID,
+			PayloadID: source.PayloadID,
+		})
 	}
 
-	prepare := func() {
-		t.rw.Lock()
-		defer t.rw.Unlock()
-
-		t.merkleDAG = &mkdag.MerkleDAG{
-			Version:      version,
-			RootMerkleID: rootMerkleID,
-			MerkleGraph:  make(mkdag.MerkleGraph, sourcesResp.Size),
-			PayloadMap:   make(mkdag.PayloadMap, sourcesResp.Size),
-			Sources:      sources,
-		}
+	if err := mkdag.VerifyRoot(t.getHasher(), rootMerkleID, sourceMerkleIDs); err != nil {
+		t.setFailed(err)
+		return nil, false
 	}
 
-	prepare()
+	t.rw.Lock()
+	t.merkleDAG.Sources = sources
+	t.rw.Unlock()
 
-	var f func(mkdag.MerkleID, []protocol.QueryItem)
-	f = func(prev mkdag.MerkleID, items []protocol.QueryItem) {
-		defer t.wg.Done()
+	return items, true
+}
 
-		var fetchList []protocol.QueryItem
-		for _, item := range items {
-			if t.isVisitedMerkleID(item.MerkleID) {
-				continue
-			}
+// syncDelta asks the observable for the nodes and payloads of the root the
+// local state does not have, so the walk takes them from a single response
+// instead of querying level by level. The walk goes on as usual if the
+// observable no longer has the local root, or has no /delta.
+func (t *Task) syncDelta() {
+	from := state.GetRootMerkleID()
+	if from == "" {
+		return
+	}
 
-			if t.migrate(item.MerkleID, item.PayloadID) {
-				continue
-			}
+	resp, err := observable.Delta(t.ctx, from, t.GetRootMerkleID())
+	if err != nil {
+		fmt.Println("Delta not available, walking the MerkleDAG, err: ", err)
+		return
+	}
 
-			fetchList = append(fetchList, item)
-		}
+	t.prefetch(resp.Nodes)
 
-		for _, item := range fetchList {
-			t.wg.Add(1)
-			go t.syncPayload(item.PayloadID)
-		}
+	t.rw.Lock()
+	for payloadID, payload := range resp.Payloads {
+		t.prefetchedPayloads[payloadID] = payload
+	}
+	t.rw.Unlock()
+}
 
-		if prev != "" {
-			var nodes []*mkdag.Node
-			for _, item := range items {
-				nodes = append(nodes, &mkdag.Node{
-					MerkleID:  item.MerkleID,
-					PayloadID: item.PayloadID,
-				})
-			}
-			t.setMerkleGraph(prev, nodes)
-		}
+func (t *Task) prefetch(nodes protocol.QueryResponse) {
+	t.rw.Lock()
+	defer t.rw.Unlock()
 
-		var edges []mkdag.MerkleID
-		for _, item := range fetchList {
-			edges = append(edges, item.MerkleID)
-		}
-		t.sem.Acquire(t.ctx, 1)
-		defer t.sem.Release(1)
-		resp, err := doQuery(t.ctx, edges)
-		if err != nil {
-			t.setFailed(err)
-			return
-		}
+	for merkleID, children := range nodes {
+		t.prefetchedNodes[merkleID] = children
+	}
+}
 
-		for merkleID, v := range *resp {
-			if len(v) == 0 {
-				t.setMerkleGraph(merkleID, nil)
-				continue
-			}
+// takePrefetched splits the items into the ones with prefetched children,
+// with those children, and the rest to query.
+func (t *Task) takePrefetched(items []protocol.QueryItem) (found []protocol.QueryItem, resp protocol.QueryResponse, rest []protocol.QueryItem) {
+	t.rw.Lock()
+	defer t.rw.Unlock()
 
-			t.wg.Add(1)
-			go f(merkleID, v)
+	resp = make(protocol.QueryResponse)
+	for _, item := range items {
+		children, ok := t.prefetchedNodes[item.MerkleID]
+		if !ok {
+			rest = append(rest, item)
+			continue
 		}
+		delete(t.prefetchedNodes, item.MerkleID)
+		found = append(found, item)
+		resp[item.MerkleID] = children
 	}
+	return found, resp, rest
+}
 
-	var items []protocol.QueryItem
-	for _, source := range sources {
-		items = append(items, protocol.QueryItem{
-			MerkleID:  source.MerkleID,
-			PayloadID: source.PayloadID,
-		})
-	}
+// takePrefetchedPayload returns the payload if it was prefetched.
+func (t *Task) takePrefetchedPayload(payloadID mkdag.PayloadID) (mkdag.Payload, bool) {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+
+	payload, ok := t.prefetchedPayloads[payloadID]
+	delete(t.prefetchedPayloads, payloadID)
+	return payload, ok
+}
 
-	t.wg.Add(1)
-	go f("", items)
+func (t *Task) run(queries []protocol.QueryItem, payloadIDs []mkdag.PayloadID) {
+	if len(payloadIDs) > 0 {
+		t.wg.Add(1)
+		go t.syncPayloads(payloadIDs)
+	}
+	if len(queries) > 0 {
+		t.wg.Add(1)
+		go t.walk("", queries)
+	}
 
 	t.wg.Wait()
-	status := t.GetTaskStatus()
+	t.finish()
+}
+
+func (t *Task) finish() {
+	t.rw.Lock()
+	if t.status == TaskStatusInProgress && t.hasPending() {
+		// Every failure was within the budget, but the MerkleDAG is not
+		// complete
+		t.cancel()
+		t.status = TaskStatusFailed
+	}
+	status := t.status
+	t.rw.Unlock()
+
 	if status == TaskStatusFailed {
 		fmt.Println("Task failed")
 	}
@@ -367,10 +566,172 @@ func (t *Task) StartTask(rootMerkleID mkdag.MerkleID, version int64) {
 	}
 }
 
+// Must be called with t.rw held.
+func (t *Task) hasPending() bool {
+	return t.pendingSources || len(t.pendingQueries) > 0 || len(t.pendingPayloads) > 0
+}
+
+// fail records the work of a failed request for Resume. The task goes on
+// with the rest until the failures exceed the failure budget, it is then no
+// longer resumed for this root.
+func (t *Task) fail(err error, pending func()) {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+
+	pending()
+
+	if t.ctx.Err() != nil {
+		// Cancelled by an earlier failure, not a failure on its own
+		return
+	}
+
+	t.failures++
+	fmt.Println("Request failed, err: ", err)
+	if t.failures > failureBudget {
+		t.cancel()
+		t.status = TaskStatusFailed
+		t.resumable = false
+		fmt.Println("Failure budget exhausted, failures: ", t.failures)
+	}
+}
+
+// walk fetches the children of the items, prev is their parent.
+func (t *Task) walk(prev mkdag.MerkleID, items []protocol.QueryItem) {
+	defer t.wg.Done()
+
+	var fetchList []protocol.QueryItem
+	for _, item := range items {
+		if payloadID, ok := t.visitedPayloadID(item.MerkleID); ok {
+			if payloadID != item.PayloadID {
+				t.setFailed(pairingError(item.MerkleID, item.PayloadID, payloadID))
+				return
+			}
+			continue
+		}
+
+		migrated, corrupt, err := t.migrate(item.MerkleID, item.PayloadID)
+		// Dropped from the store once migrate released the locks
+		state.invalidate()
+		if err != nil {
+			t.setFailed(err)
+			return
+		}
+		fetchList = append(fetchList, corrupt...)
+		if migrated {
+			continue
+		}
+
+		fetchList = append(fetchList, item)
+	}
+
+	if len(fetchList) > 0 {
+		payloadIDs := make([]mkdag.PayloadID, 0, len(fetchList))
+		for _, item := range fetchList {
+			payloadIDs = append(payloadIDs, item.PayloadID)
+		}
+		t.wg.Add(1)
+		go t.syncPayloads(payloadIDs)
+	}
+
+	if prev != "" {
+		var nodes []*mkdag.Node
+		for _, item := range items {
+			nodes = append(nodes, &mkdag.Node{
+				MerkleID:  item.MerkleID,
+				PayloadID: item.PayloadID,
+			})
+		}
+		t.setMerkleGraph(prev, nodes)
+	}
+
+	found, resp, fetchList := t.takePrefetched(fetchList)
+	if len(found) > 0 {
+		// Verified like a query response, prefetched nodes are not trusted
+		// either
+		if err := verifyQuery(t.getHasher(), found, resp); err != nil {
+			t.setFailed(err)
+			return
+		}
+		t.expand(found, resp)
+	}
+
+	if len(fetchList) == 0 {
+		return
+	}
+
+	pending := func() {
+		t.pendingQueries = append(t.pendingQueries, fetchList...)
+	}
+
+	var edges []mkdag.MerkleID
+	for _, item := range fetchList {
+		edges = append(edges, item.MerkleID)
+	}
+	if err := t.sem.Acquire(t.ctx, 1); err != nil {
+		t.fail(err, pending)
+		return
+	}
+	resp, err := observable.QueryTree(t.ctx, t.GetRootMerkleID(), t.getDepth(), protocol.QueryTreeRequest{
+		IDs:        edges,
+		HaveFilter: t.getHaveFilter(),
+	})
+	t.sem.Release(1)
+	if err != nil {
+		t.fail(err, pending)
+		return
+	}
+
+	// The deeper levels are walked from their parents. A subtree the
+	// observable left out on a false positive of the filter is queried once
+	// the walk gets to it, as migrate does not find it.
+	resp, deeper := splitQuery(fetchList, resp)
+	t.prefetch(deeper)
+
+	if err := verifyQuery(t.getHasher(), fetchList, resp); err != nil {
+		t.setFailed(err)
+		return
+	}
+
+	t.expand(fetchList, resp)
+}
+
+// expand walks the children of the verified items.
+func (t *Task) expand(items []protocol.QueryItem, resp protocol.QueryResponse) {
+	t.rw.Lock()
+	for _, item := range items {
+		t.pairing[item.MerkleID] = item.PayloadID
+	}
+	t.rw.Unlock()
+
+	expanded := make(utils.Set[mkdag.MerkleID], len(items))
+	for _, item := range items {
+		if expanded.Contains(item.MerkleID) {
+			continue
+		}
+		expanded.Add(item.MerkleID)
+
+		v := resp[item.MerkleID]
+		if len(v) == 0 {
+			t.setMerkleGraph(item.MerkleID, nil)
+			continue
+		}
+
+		t.wg.Add(1)
+		go t.walk(item.MerkleID, v)
+	}
+}
+
 func (t *Task) syncPayload(payloadID mkdag.PayloadID) {
 	defer t.wg.Done()
 
-	t.sem.Acquire(t.ctx, 1)
+	pending := func() {
+		t.pendingPayloads = append(t.pendingPayloads, payloadID)
+	}
+
+	if err := t.sem.Acquire(t.ctx, 1); err != nil {
+		t.fail(err, pending)
+		return
+	}
 	defer t.sem.Release(1)
 
 	// Maybe on request not done
@@ -389,11 +750,151 @@ func (t *Task) syncPayload(payloadID mkdag.PayloadID) {
 		return
 	}
 
-	resp, err := getPayload(t.ctx, payloadID)
+	resp, err := observable.Payload(t.ctx, t.GetRootMerkleID(), payloadID)
 	if err != nil {
+		t.fail(err, pending)
+		return
+	}
+
+	if err := mkdag.VerifyPayload(t.getHasher(), payloadID, resp.Payload); err != nil {
 		t.setFailed(err)
 		return
 	}
 
 	t.setPayload(payloadID, resp.Payload)
 }
+
+// Max number of payloads fetched by a single /payloads request
+const payloadsBatchSize = 1000
+
+func (t *Task) syncPayloads(payloadIDs []mkdag.PayloadID) {
+	defer t.wg.Done()
+
+	var fetchList []mkdag.PayloadID
+	for _, payloadID := range payloadIDs {
+		if t.isVisitedPayloadID(payloadID) {
+			continue
+		}
+
+		payload, exist := state.GetPayload(payloadID)
+		if exist {
+			t.setPayload(payloadID, payload)
+			continue
+		}
+
+		payload, exist = t.takePrefetchedPayload(payloadID)
+		if exist {
+			if err := mkdag.VerifyPayload(t.getHasher(), payloadID, payload); err != nil {
+				t.setFailed(err)
+				return
+			}
+			t.setPayload(payloadID, payload)
+			continue
+		}
+
+		fetchList = append(fetchList, payloadID)
+	}
+
+	for len(fetchList) > 0 {
+		n := payloadsBatchSize
+		if n > len(fetchList) {
+			n = len(fetchList)
+		}
+		batch := fetchList[:n]
+		fetchList = fetchList[n:]
+
+		t.fetchPayloads(batch)
+	}
+}
+
+func (t *Task) fetchPayloads(payloadIDs []mkdag.PayloadID) {
+	pending := func(payloadIDs ...mkdag.PayloadID) func() {
+		return func() {
+			t.pendingPayloads = append(t.pendingPayloads, payloadIDs...)
+		}
+	}
+
+	if err := t.sem.Acquire(t.ctx, 1); err != nil {
+		t.fail(err, pending(payloadIDs...))
+		return
+	}
+	resp, err := observable.Payloads(t.ctx, t.GetRootMerkleID(), payloadIDs)
+	t.sem.Release(1)
+	if errors.Is(err, client.ErrUnsupported) {
+		// Older observable, fetch one by one
+		for _, payloadID := range payloadIDs {
+			t.wg.Add(1)
+			go t.syncPayload(payloadID)
+		}
+		return
+	}
+	if err != nil {
+		t.fail(err, pending(payloadIDs...))
+		return
+	}
+
+	if len(resp.Missing) > 0 {
+		err := fmt.Errorf("payloads not found, payload_ids: %v", resp.Missing)
+		t.fail(err, pending(resp.Missing...))
+	}
+
+	hasher := t.getHasher()
+	for _, payloadID := range payloadIDs {
+		payload, ok := resp.Payloads[payloadID]
+		if !ok {
+			continue
+		}
+		if err := mkdag.VerifyPayload(hasher, payloadID, payload); err != nil {
+			t.setFailed(err)
+			return
+		}
+		t.setPayload(payloadID, payload)
+	}
+}
+
+// splitQuery splits a response into the nodes of the items and the deeper
+// ones.
+func splitQuery(items []protocol.QueryItem, resp protocol.QueryResponse) (requested, deeper protocol.QueryResponse) {
+	requested = make(protocol.QueryResponse, len(items))
+	for _, item := range items {
+		if children, ok := resp[item.MerkleID]; ok {
+			requested[item.MerkleID] = children
+		}
+	}
+	deeper = make(protocol.QueryResponse, len(resp)-len(requested))
+	for merkleID, children := range resp {
+		if _, ok := requested[merkleID]; !ok {
+			deeper[merkleID] = children
+		}
+	}
+	return requested, deeper
+}
+
+// Every queried node must be in the response, with children hashing to its
+// MerkleID, so the observable can not make the observer store a graph which
+// does not match the root.
+func verifyQuery(hasher mkdag.Hasher, items []protocol.QueryItem, resp protocol.QueryResponse) error {
+	requested := make(utils.Set[mkdag.MerkleID], len(items))
+	for _, item := range items {
+		requested.Add(item.MerkleID)
+		children, ok := resp[item.MerkleID]
+		if !ok {
+			return fmt.Errorf("merkle node not found, merkle_id: %s", item.MerkleID)
+		}
+
+		merkleIDs := make([]mkdag.MerkleID, 0, len(children))
+		for _, child := range children {
+			merkleIDs = append(merkleIDs, child.MerkleID)
+		}
+		if err := mkdag.VerifyNode(hasher, item.MerkleID, item.PayloadID, merkleIDs); err != nil {
+			return err
+		}
+	}
+
+	for merkleID := range resp {
+		if !requested.Contains(merkleID) {
+			return fmt.Errorf("merkle node not requested, merkle_id: %s", merkleID)
+		}
+	}
+	return nil
+}
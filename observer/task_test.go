@@ -0,0 +1,190 @@
+package main
+
+import (
+	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
+	"dag-poll/pkg/protocol"
+	"dag-poll/pkg/store"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// failing serves h, answering 503 to the requests under the path prefix, none
+// if empty.
+type failing struct {
+	h      http.Handler
+	prefix atomic.Pointer[string]
+}
+
+func (f *failing) fail(prefix string) {
+	f.prefix.Store(&prefix)
+}
+
+func (f *failing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if prefix := f.prefix.Load(); prefix != nil && *prefix != "" && strings.HasPrefix(r.URL.Path, *prefix) {
+		http.Error(w, protocol.Error("Unavailable"), http.StatusServiceUnavailable)
+		return
+	}
+	f.h.ServeHTTP(w, r)
+}
+
+func rootOf(m *mkdag.MerkleDAG) *protocol.RootResponse {
+	return &protocol.RootResponse{
+		ID:        m.RootMerkleID,
+		Hash:      m.GetHasher().Name(),
+		Version:   m.Version,
+		Timestamp: m.Timestamp,
+	}
+}
+
+// synced checks the state is the MerkleDAG, all of it.
+func synced(t *testing.T, m *mkdag.MerkleDAG) {
+	t.Helper()
+
+	if state.GetRootMerkleID() != m.RootMerkleID {
+		t.Fatalf("root not synced, expected: %s, actual: %s", m.RootMerkleID, state.GetRootMerkleID())
+	}
+	if state.MerkleGraph.Len() != m.MerkleGraph.Len() || state.PayloadMap.Len() != m.PayloadMap.Len() {
+		t.Errorf("MerkleDAG not complete, nodes: %d/%d, payloads: %d/%d",
+			state.MerkleGraph.Len(), m.MerkleGraph.Len(), state.PayloadMap.Len(), m.PayloadMap.Len())
+	}
+}
+
+func TestTaskResume(t *testing.T) {
+	reset(t)
+	failureBudget = 1000
+
+	s := newServer(t)
+	f := &failing{h: s}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	observable = newMirrors(t, ts.URL)
+
+	m := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+
+	// Within the budget, the graph is walked and the payloads left for Resume
+	f.fail("/payloads")
+	task.StartTask(rootOf(m), mkdag.DefaultHasher)
+	if !task.IsResumable() {
+		t.Fatalf("task not resumable, status: %s", task.GetTaskStatus())
+	}
+	f.fail("")
+	task.Resume()
+	if status := task.GetTaskStatus(); status != TaskStatusDone {
+		t.Fatalf("task not done, status: %s", status)
+	}
+	synced(t, m)
+
+	// Given up for the root once the budget is exhausted
+	failureBudget = 0
+	f.fail("/")
+	next := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+	task.StartTask(rootOf(next), mkdag.DefaultHasher)
+	if task.GetTaskStatus() != TaskStatusFailed || task.IsResumable() {
+		t.Errorf("task resumable past its budget, status: %s", task.GetTaskStatus())
+	}
+}
+
+func TestTaskCorruptState(t *testing.T) {
+	reset(t)
+	s, ts := newObservable(t)
+	observable = newMirrors(t, ts.URL)
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	m := publish(t, s, d)
+
+	// A local copy missing a Merkle node and a payload, e.g. lost files of
+	// the store
+	local := mkdag.GenerateMerkleDAG(d, nil, nil)
+	var children []*mkdag.Node
+	local.MerkleGraph.Range(func(_ mkdag.MerkleID, nodes []*mkdag.Node) bool {
+		children = nodes
+		return len(children) < 2
+	})
+	if len(children) < 2 {
+		t.Fatal("no node with two children")
+	}
+	local.MerkleGraph.Delete(children[0].MerkleID)
+	local.PayloadMap.Delete(children[1].PayloadID)
+	state.setMerkleDAG(local)
+
+	// Still in the store, dropped from it once marked corrupt
+	dir := t.TempDir()
+	var err error
+	if localStore, err = store.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := localStore.Save(m); err != nil {
+		t.Fatal(err)
+	}
+
+	task.StartTask(rootOf(m), mkdag.DefaultHasher)
+	if status := task.GetTaskStatus(); status != TaskStatusDone {
+		t.Fatalf("task not done, status: %s", status)
+	}
+	synced(t, m)
+	if state.corruptCount < 2 {
+		t.Errorf("missing entries not marked corrupt, count: %d", state.corruptCount)
+	}
+
+	reopened, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, missing, err := reopened.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{children[0].MerkleID, children[1].PayloadID} {
+		if !slices.Contains(missing, id) {
+			t.Errorf("corrupt entry %s not invalidated, missing: %v", id, missing)
+		}
+	}
+}
+
+func TestTaskDeltaVerified(t *testing.T) {
+	reset(t)
+	s := newServer(t)
+	// Payloads of /delta replaced, not matching their PayloadIDs
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/delta" {
+			s.ServeHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", r.URL.String(), nil))
+		var resp protocol.DeltaResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			http.Error(w, protocol.Error(err.Error()), http.StatusInternalServerError)
+			return
+		}
+		for payloadID := range resp.Payloads {
+			resp.Payloads[payloadID] = "dGFtcGVyZWQ="
+		}
+		w.Header().Set("Content-Type", protocol.ContentTypeJSON)
+		resp.Pipe(w)
+	}))
+	t.Cleanup(ts.Close)
+	observable = newMirrors(t, ts.URL)
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	prev := publish(t, s, d)
+	state.setMerkleDAG(mkdag.GenerateMerkleDAG(d, nil, nil))
+
+	next := d.Clone()
+	next.UpdateRandomNodes(10)
+	m := publish(t, s, next)
+
+	task.StartTask(rootOf(m), mkdag.DefaultHasher)
+	if task.GetTaskStatus() != TaskStatusFailed || task.IsResumable() {
+		t.Errorf("tampered delta not refused, status: %s", task.GetTaskStatus())
+	}
+	if state.GetRootMerkleID() != prev.RootMerkleID {
+		t.Errorf("state changed by a tampered delta")
+	}
+}
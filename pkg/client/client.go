@@ -0,0 +1,595 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"dag-poll/pkg/protocol"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// ErrNotFound is returned when the observable does not have the root,
+	// sources or payload, e.g. the root dropped out of its history.
+	ErrNotFound = errors.New("not found")
+	// ErrUnsupported is returned when the observable is too old to serve the
+	// endpoint, callers are expected to fall back to the older one.
+	ErrUnsupported = errors.New("unsupported")
+)
+
+// RetryPolicy retries requests failed with a network error or a 5xx status.
+type RetryPolicy struct {
+	// Attempts of a request including the first one, 0 or 1 disables retry
+	MaxAttempts int
+	// Delay before the first retry, doubled on every next one
+	Delay time.Duration
+	// Upper bound of the delay, 0 for none
+	MaxDelay time.Duration
+	// Fraction of the delay taken off at random, so clients failed together
+	// do not retry together, 0 to 1
+	Jitter float64
+}
+
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	if p.Delay <= 0 {
+		return 0
+	}
+	// Capped so the doubling does not overflow to a negative delay
+	shift := min(attempt-1, bits.LeadingZeros64(uint64(p.Delay))-1)
+	d := p.Delay << shift
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 && d > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+type Options struct {
+	// Base URL of the observable, e.g. http://127.0.0.1:3633
+	Endpoint string
+	// Defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// Timeout of every request but WatchRoot, which is held by the
+	// observable, 0 for none
+	Timeout time.Duration
+	// Sent with every request
+	Header http.Header
+	Retry  RetryPolicy
+	// Ask for the binary encoding of the protocol, observables which do not
+	// support it answer with JSON
+	Binary bool
+	// Do not ask for zstd or gzip compressed responses
+	DisableCompression bool
+}
+
+// Client speaks the sync protocol of an observable.
+type Client struct {
+	endpoint   string
+	httpClient *http.Client
+	timeout    time.Duration
+	header     http.Header
+	retry      RetryPolicy
+	// Set once the observable turned out to only serve the GET with a JSON
+	// body forms of the endpoints
+	legacy atomic.Bool
+	// Set once the observable turned out not to take the object form of the
+	// /query body
+	plainQuery atomic.Bool
+	// Set once the observable turned out not to have POST /have, the filter
+	// is then sent with every query
+	inlineHave atomic.Bool
+
+	// Token of the last filter registered with POST /have
+	haveMu     sync.Mutex
+	haveFilter *protocol.BloomFilter
+	haveToken  string
+}
+
+func New(opts Options) (*Client, error) {
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint: %s", opts.Endpoint)
+	}
+
+	header := opts.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if opts.Binary && header.Get("Accept") == "" {
+		header.Set("Accept", protocol.ContentTypeBinary+", "+protocol.ContentTypeJSON+";q=0.9")
+	}
+	// Set explicitly, http.Transport only decompresses gzip on its own
+	if !opts.DisableCompression && header.Get("Accept-Encoding") == "" {
+		header.Set("Accept-Encoding", "zstd, gzip")
+	}
+
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		endpoint:   strings.TrimSuffix(opts.Endpoint, "/"),
+		httpClient: httpClient,
+		timeout:    opts.Timeout,
+		header:     header,
+		retry:      opts.Retry,
+	}, nil
+}
+
+type StatusError struct {
+	Path       string
+	StatusCode int
+	// From the JSON error of the observable, empty if the body is not one,
+	// e.g. the 404 of a route it does not have
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s request failed, status: %v", e.Path, e.StatusCode)
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// routeMissing is true if the observable does not have the endpoint at all,
+// rather than the root or payload asked for.
+func routeMissing(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr.StatusCode == http.StatusMethodNotAllowed ||
+		statusErr.StatusCode == http.StatusNotFound && statusErr.Message == ""
+}
+
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	// Sent as JSON
+	body any
+}
+
+// do sends the request, retrying it by the policy. The caller closes the
+// body of the response and cancels the returned function when done with it.
+func (c *Client) do(ctx context.Context, r request, timeout time.Duration) (*http.Response, context.CancelFunc, error) {
+	var b []byte
+	if r.body != nil {
+		var err error
+		b, err = json.Marshal(r.body)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	u := c.endpoint + r.path
+	if len(r.query) > 0 {
+		u += "?" + r.query.Encode()
+	}
+
+	for attempt := 1; ; attempt++ {
+		reqCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			reqCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+
+		req, err := http.NewRequestWithContext(reqCtx, r.method, u, bytes.NewReader(b))
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		for k, v := range c.header {
+			req.Header[k] = v
+		}
+		if r.body != nil {
+			req.Header.Set("Content-Type", protocol.ContentTypeJSON)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		// A cancelled ctx is not going to succeed on retry, unlike a timed out
+		// attempt
+		if attempt >= c.retry.MaxAttempts || !retryable(resp, err) || ctx.Err() != nil {
+			if err != nil {
+				cancel()
+				return nil, nil, err
+			}
+			return resp, cancel, nil
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		cancel()
+
+		select {
+		case <-time.After(c.retry.delay(attempt)):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+type loader interface {
+	Load(io.Reader) error
+}
+
+type binaryLoader interface {
+	LoadBinary(io.Reader) error
+}
+
+func (c *Client) get(ctx context.Context, r request, timeout time.Duration, v loader) (int, error) {
+	resp, cancel, err := c.do(ctx, r, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	body, err := decompress(resp)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	defer body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		statusErr := &StatusError{Path: r.path, StatusCode: resp.StatusCode}
+		var msg protocol.ErrorMessage
+		if json.NewDecoder(io.LimitReader(body, 4096)).Decode(&msg) == nil {
+			statusErr.Message = msg.Message
+		}
+		return resp.StatusCode, statusErr
+	}
+
+	if b, ok := v.(binaryLoader); ok && protocol.IsBinary(resp) {
+		return resp.StatusCode, b.LoadBinary(body)
+	}
+	return resp.StatusCode, v.Load(body)
+}
+
+// call sends r, or legacy to an observable which does not serve r. Once
+// one does not, every next call sends legacy right away.
+func (c *Client) call(ctx context.Context, r, legacy request, v loader) (int, error) {
+	if !c.legacy.Load() {
+		status, err := c.get(ctx, r, c.timeout, v)
+		if !routeMissing(err) {
+			return status, err
+		}
+		c.legacy.Store(true)
+	}
+	return c.get(ctx, legacy, c.timeout, v)
+}
+
+// decompress returns the body of the response decoded by its
+// Content-Encoding.
+func decompress(resp *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "":
+		return resp.Body, nil
+	case "gzip":
+		return gzip.NewReader(resp.Body)
+	case "zstd":
+		r, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return r.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding: %s", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+// Pin the request to a MerkleDAG, the observable keeps serving it for a while
+// after publishing a new one. An empty root is the latest.
+func withRoot(rootMerkleID string) url.Values {
+	if rootMerkleID == "" {
+		return nil
+	}
+	return url.Values{"root": {rootMerkleID}}
+}
+
+func (c *Client) Root(ctx context.Context) (*protocol.RootResponse, error) {
+	var r protocol.RootResponse
+	status, err := c.get(ctx, request{method: http.MethodGet, path: "/root"}, c.timeout, &r)
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("root %w", ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// WatchRoot blocks until the root of the observable is different from since,
+// or the observable times out the request. Returns ErrUnsupported if the
+// observable has no /root/watch, and ErrNotFound if it answers 404 for what
+// it serves under the endpoint, e.g. a namespace it does not have.
+func (c *Client) WatchRoot(ctx context.Context, since string) (*protocol.RootResponse, error) {
+	var r protocol.RootResponse
+	req := request{method: http.MethodGet, path: "/root/watch", query: url.Values{"since": {since}}}
+	status, err := c.get(ctx, req, 0, &r)
+	if routeMissing(err) {
+		return nil, fmt.Errorf("watch root %w", ErrUnsupported)
+	}
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("watch root %w", ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func (c *Client) Sources(ctx context.Context, rootMerkleID string) (*protocol.SourcesResponse, error) {
+	var r protocol.SourcesResponse
+	status, err := c.call(ctx, request{
+		method: http.MethodGet,
+		path:   "/sources/" + url.PathEscape(rootMerkleID),
+	}, request{
+		method: http.MethodGet,
+		path:   "/sources",
+		body:   protocol.SourceRequest{ID: rootMerkleID},
+	}, &r)
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("sources %w, root_id: %v", ErrNotFound, rootMerkleID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// Query returns the children of the Merkle nodes in the MerkleDAG of the root.
+func (c *Client) Query(ctx context.Context, rootMerkleID string, merkleIDs []string) (protocol.QueryResponse, error) {
+	return c.QueryTree(ctx, rootMerkleID, 1, protocol.QueryTreeRequest{IDs: merkleIDs})
+}
+
+// QueryTree returns the subtrees of the Merkle nodes of the request down to
+// depth levels in a single request, leaving out the subtrees of the MerkleIDs
+// it has. An observable may return fewer levels, older ones only return the
+// children. The HaveFilter is registered once with POST /have and sent as its
+// token by the next queries with the same filter, in the body to observables
+// without /have. Those rejecting the object form of the body are sent the
+// MerkleIDs alone from then on, and a depth of 1 instead of one which would
+// return the subtrees the request has.
+func (c *Client) QueryTree(ctx context.Context, rootMerkleID string, depth int, req protocol.QueryTreeRequest) (protocol.QueryResponse, error) {
+	var r protocol.QueryResponse
+	withDepth := func(depth int) url.Values {
+		query := withRoot(rootMerkleID)
+		if depth > 1 {
+			if query == nil {
+				query = make(url.Values)
+			}
+			query.Set("depth", strconv.Itoa(depth))
+		}
+		return query
+	}
+
+	sendsHave := len(req.Have) > 0 || req.HaveFilter != nil
+	plain := !sendsHave || c.plainQuery.Load()
+	var status int
+	var err error
+	if !plain {
+		status, err = c.queryHave(ctx, withDepth(depth), req, &r)
+		if bodyRejected(err) {
+			c.plainQuery.Store(true)
+			plain = true
+		}
+	}
+	if plain {
+		if sendsHave {
+			depth = 1
+		}
+		status, err = c.query(ctx, withDepth(depth), protocol.QueryRequest(req.IDs), &r)
+	}
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("query root %w, root_id: %v", ErrNotFound, rootMerkleID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// queryHave sends the query with the token of its HaveFilter, registering the
+// filter on the first query, and again if the observable dropped the token.
+func (c *Client) queryHave(ctx context.Context, query url.Values, req protocol.QueryTreeRequest, v loader) (int, error) {
+	if req.HaveFilter == nil || c.inlineHave.Load() {
+		return c.query(ctx, query, req, v)
+	}
+
+	var stale string
+	for {
+		token, err := c.have(ctx, req.HaveFilter, stale)
+		if errors.Is(err, ErrUnsupported) {
+			c.inlineHave.Store(true)
+			return c.query(ctx, query, req, v)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		status, err := c.query(ctx, query, protocol.QueryTreeRequest{
+			IDs:       req.IDs,
+			Have:      req.Have,
+			HaveToken: token,
+		}, v)
+		if status != http.StatusGone || stale != "" {
+			return status, err
+		}
+		stale = token
+	}
+}
+
+// have returns the token of the filter, registered with POST /have unless it
+// already was, or its token is the stale one.
+func (c *Client) have(ctx context.Context, filter *protocol.BloomFilter, stale string) (string, error) {
+	c.haveMu.Lock()
+	defer c.haveMu.Unlock()
+
+	if c.haveFilter == filter && c.haveToken != "" && c.haveToken != stale {
+		return c.haveToken, nil
+	}
+
+	var r protocol.HaveResponse
+	_, err := c.get(ctx, request{
+		method: http.MethodPost,
+		path:   "/have",
+		body:   protocol.HaveRequest{HaveFilter: filter},
+	}, c.timeout, &r)
+	if routeMissing(err) {
+		return "", fmt.Errorf("have %w", ErrUnsupported)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	c.haveFilter, c.haveToken = filter, r.Token
+	return r.Token, nil
+}
+
+// bodyRejected is true if the observable could not read the body of the
+// request, rather than rejecting what it asks for.
+func bodyRejected(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) &&
+		statusErr.StatusCode == http.StatusBadRequest && statusErr.Message == "Invalid http.Body"
+}
+
+func (c *Client) query(ctx context.Context, query url.Values, body any, v loader) (int, error) {
+	return c.call(ctx, request{
+		method: http.MethodPost,
+		path:   "/query",
+		query:  query,
+		body:   body,
+	}, request{
+		method: http.MethodGet,
+		path:   "/query",
+		query:  query,
+		body:   body,
+	}, v)
+}
+
+func (c *Client) Payload(ctx context.Context, rootMerkleID string, payloadID string) (*protocol.PayloadResponse, error) {
+	var r protocol.PayloadResponse
+	status, err := c.call(ctx, request{
+		method: http.MethodGet,
+		path:   "/payload/" + url.PathEscape(payloadID),
+		query:  withRoot(rootMerkleID),
+	}, request{
+		method: http.MethodGet,
+		path:   "/payload",
+		query:  withRoot(rootMerkleID),
+		body:   protocol.PayloadRequest{PayloadID: payloadID},
+	}, &r)
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("payload %w, payload_id: %v", ErrNotFound, payloadID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// Payloads fetches the payloads in a single request. Returns ErrUnsupported
+// if the observable has no /payloads, use Payload instead.
+func (c *Client) Payloads(ctx context.Context, rootMerkleID string, payloadIDs []string) (*protocol.PayloadsResponse, error) {
+	var r protocol.PayloadsResponse
+	body := protocol.PayloadsRequest(payloadIDs)
+	status, err := c.call(ctx, request{
+		method: http.MethodPost,
+		path:   "/payloads",
+		query:  withRoot(rootMerkleID),
+		body:   body,
+	}, request{
+		method: http.MethodGet,
+		path:   "/payloads",
+		query:  withRoot(rootMerkleID),
+		body:   body,
+	}, &r)
+	if routeMissing(err) {
+		return nil, fmt.Errorf("payloads %w", ErrUnsupported)
+	}
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("payloads root %w, root_id: %v", ErrNotFound, rootMerkleID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// Diff returns what changed from the root from to the root to, the current
+// one if empty. Returns ErrUnsupported if the observable has no /diff.
+func (c *Client) Diff(ctx context.Context, from string, to string) (*protocol.DiffResponse, error) {
+	var r protocol.DiffResponse
+	query := url.Values{"from": {from}}
+	if to != "" {
+		query.Set("to", to)
+	}
+	status, err := c.get(ctx, request{method: http.MethodGet, path: "/diff", query: query}, c.timeout, &r)
+	if routeMissing(err) {
+		return nil, fmt.Errorf("diff %w", ErrUnsupported)
+	}
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("diff root %w, from: %v, to: %v", ErrNotFound, from, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// Delta returns the Merkle nodes and payloads of the root to, the current one
+// if empty, that the root from does not have. Returns ErrNotFound if the
+// observable no longer has from, and ErrUnsupported if it has no /delta.
+func (c *Client) Delta(ctx context.Context, from string, to string) (*protocol.DeltaResponse, error) {
+	var r protocol.DeltaResponse
+	query := url.Values{"from": {from}}
+	if to != "" {
+		query.Set("to", to)
+	}
+	status, err := c.get(ctx, request{method: http.MethodGet, path: "/delta", query: query}, c.timeout, &r)
+	if routeMissing(err) {
+		return nil, fmt.Errorf("delta %w", ErrUnsupported)
+	}
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("delta root %w, from: %v, to: %v", ErrNotFound, from, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
@@ -0,0 +1,312 @@
+package client_test
+
+import (
+	"compress/gzip"
+	"context"
+	"dag-poll/pkg/client"
+	"dag-poll/pkg/protocol"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newClient(t *testing.T, h http.Handler, opts client.Options) *client.Client {
+	t.Helper()
+
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+
+	opts.Endpoint = s.URL
+	c, err := client.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestQuery(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("root") != "root" {
+			t.Errorf("root not pinned, query: %s", r.URL.RawQuery)
+		}
+		if r.Header.Get("Authorization") != "token" {
+			t.Errorf("header not sent")
+		}
+
+		var req protocol.QueryRequest
+		if err := req.Load(r); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := make(protocol.QueryResponse)
+		for _, id := range req {
+			resp[id] = []protocol.QueryItem{{MerkleID: id + "-child", PayloadID: "p"}}
+		}
+		resp.Pipe(w)
+	})
+
+	c := newClient(t, mux, client.Options{
+		Header: http.Header{"Authorization": {"token"}},
+	})
+
+	resp, err := c.Query(context.Background(), "root", []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 2 || resp["a"][0].MerkleID != "a-child" {
+		t.Errorf("unexpected response: %v", resp)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var calls atomic.Int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, protocol.Error("Unavailable"), http.StatusServiceUnavailable)
+			return
+		}
+		resp := protocol.RootResponse{ID: "root", Version: 1}
+		resp.Pipe(w)
+	})
+
+	c := newClient(t, h, client.Options{
+		Retry: client.RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond},
+	})
+
+	resp, err := c.Root(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != "root" || calls.Load() != 3 {
+		t.Errorf("unexpected response: %v, calls: %d", resp, calls.Load())
+	}
+
+	calls.Store(0)
+	c = newClient(t, h, client.Options{
+		Retry: client.RetryPolicy{MaxAttempts: 2, Delay: time.Millisecond},
+	})
+
+	_, err = c.Root(context.Background())
+	var statusErr *client.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status error, err: %v", err)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	var calls atomic.Int32
+	c := newClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.NotFound(w, r)
+	}), client.Options{
+		Retry: client.RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond},
+	})
+
+	if _, err := c.Payload(context.Background(), "", "id"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected not found, err: %v", err)
+	}
+	if _, err := c.Payloads(context.Background(), "", []string{"id"}); !errors.Is(err, client.ErrUnsupported) {
+		t.Errorf("expected unsupported, err: %v", err)
+	}
+	if _, err := c.WatchRoot(context.Background(), ""); !errors.Is(err, client.ErrUnsupported) {
+		t.Errorf("expected unsupported, err: %v", err)
+	}
+	// Payload falls back to the legacy /payload once, after which Payloads
+	// goes straight to it
+	if calls.Load() != 4 {
+		t.Errorf("4xx must not be retried, calls: %d", calls.Load())
+	}
+}
+
+func TestCompressedError(t *testing.T) {
+	c := newClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusNotFound)
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte(protocol.Error("Namespace not found")))
+		zw.Close()
+	}), client.Options{})
+
+	// A 404 with a message is not a missing route, which takes the message
+	// to be decompressed
+	if _, err := c.WatchRoot(context.Background(), ""); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected not found, err: %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	c := newClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}), client.Options{Timeout: 10 * time.Millisecond})
+
+	if _, err := c.Sources(context.Background(), "root"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, err: %v", err)
+	}
+}
+
+func TestLegacyFallback(t *testing.T) {
+	var calls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sources", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req protocol.SourceRequest
+		if r.Method != "GET" || req.Load(r) != nil || req.ID != "root" {
+			http.Error(w, protocol.Error("Invalid http.Body"), http.StatusBadRequest)
+			return
+		}
+		resp := protocol.SourcesResponse{Size: 1, Sources: []protocol.Source{{ID: "a"}}}
+		resp.Pipe(w)
+	})
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Method != "GET" {
+			http.Error(w, protocol.Error("Method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		protocol.QueryResponse{"a": nil}.Pipe(w)
+	})
+	mux.HandleFunc("/payload", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, protocol.Error("Payload not found"), http.StatusNotFound)
+	})
+
+	c := newClient(t, mux, client.Options{})
+	ctx := context.Background()
+
+	sources, err := c.Sources(ctx, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sources.Size != 1 || calls.Load() != 1 {
+		t.Errorf("unexpected sources: %v, calls: %d", sources, calls.Load())
+	}
+
+	if _, err := c.Query(ctx, "root", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Payload(ctx, "root", "p"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected not found, err: %v", err)
+	}
+	// Only /sources/root was not served, then the legacy forms are sent
+	// right away
+	if calls.Load() != 3 {
+		t.Errorf("legacy forms not remembered, calls: %d", calls.Load())
+	}
+}
+
+func TestQueryTreeFallback(t *testing.T) {
+	var calls atomic.Int32
+	mux := http.NewServeMux()
+	// An observable taking the array of MerkleIDs only
+	mux.HandleFunc("POST /query", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req protocol.QueryRequest
+		if req.Load(r) != nil {
+			http.Error(w, protocol.Error("Invalid http.Body"), http.StatusBadRequest)
+			return
+		}
+		// Without the filter, deeper levels would be the subtrees it has
+		if depth := r.URL.Query().Get("depth"); depth != "" {
+			t.Errorf("depth sent without the filter: %s", depth)
+		}
+		protocol.QueryResponse{"a": nil}.Pipe(w)
+	})
+
+	c := newClient(t, mux, client.Options{})
+	ctx := context.Background()
+	req := protocol.QueryTreeRequest{IDs: []string{"a"}, HaveFilter: protocol.NewBloomFilter(10, 0.01)}
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.QueryTree(ctx, "root", 4, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := resp["a"]; !ok {
+			t.Errorf("unexpected response: %v", resp)
+		}
+	}
+	// The filter is dropped once, then not sent again
+	if calls.Load() != 3 {
+		t.Errorf("fallback not remembered, calls: %d", calls.Load())
+	}
+}
+
+func TestQueryTreeHave(t *testing.T) {
+	var registered, queries atomic.Int32
+	var reject atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /have", func(w http.ResponseWriter, r *http.Request) {
+		var req protocol.HaveRequest
+		if req.Load(r.Body) != nil || req.HaveFilter == nil {
+			http.Error(w, protocol.Error("Invalid http.Body"), http.StatusBadRequest)
+			return
+		}
+		n := registered.Add(1)
+		resp := protocol.HaveResponse{Token: fmt.Sprint("token-", n), TTL: 60}
+		resp.Pipe(w)
+	})
+	mux.HandleFunc("POST /query", func(w http.ResponseWriter, r *http.Request) {
+		n := queries.Add(1)
+		var req protocol.QueryTreeRequest
+		if req.Load(r) != nil {
+			http.Error(w, protocol.Error("Invalid http.Body"), http.StatusBadRequest)
+			return
+		}
+		if req.HaveFilter != nil {
+			t.Errorf("filter sent with the query")
+		}
+		// The observable drops the first token after the second query
+		if n == 3 && req.HaveToken == "token-1" {
+			http.Error(w, protocol.Error("Have token not found"), http.StatusGone)
+			return
+		}
+		if req.HaveToken == "" {
+			t.Errorf("token not sent")
+		}
+		if reject.Load() {
+			http.Error(w, protocol.Error("Invalid depth"), http.StatusBadRequest)
+			return
+		}
+		protocol.QueryResponse{"a": nil}.Pipe(w)
+	})
+
+	c := newClient(t, mux, client.Options{})
+	ctx := context.Background()
+	req := protocol.QueryTreeRequest{IDs: []string{"a"}, HaveFilter: protocol.NewBloomFilter(10, 0.01)}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.QueryTree(ctx, "root", 4, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if registered.Load() != 2 || queries.Load() != 4 {
+		t.Errorf("expected a registration per token, registered: %d, queries: %d", registered.Load(), queries.Load())
+	}
+
+	// Not an unreadable body, the object form is still sent after it
+	reject.Store(true)
+	if _, err := c.QueryTree(ctx, "root", 4, req); err == nil {
+		t.Errorf("expected the 400 to be returned")
+	}
+	reject.Store(false)
+	if _, err := c.QueryTree(ctx, "root", 4, req); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new filter is registered on its own
+	req.HaveFilter = protocol.NewBloomFilter(10, 0.01)
+	if _, err := c.QueryTree(ctx, "root", 4, req); err != nil {
+		t.Fatal(err)
+	}
+	if registered.Load() != 3 {
+		t.Errorf("new filter not registered, registered: %d", registered.Load())
+	}
+}
@@ -0,0 +1,381 @@
+package dag
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNodeExists   = errors.New("node already exists")
+	ErrNodeNotFound = errors.New("node not found")
+	ErrEdgeExists   = errors.New("edge already exists")
+	ErrEdgeNotFound = errors.New("edge not found")
+	ErrSelfLoop     = errors.New("edge is a self-loop")
+	ErrCycle        = errors.New("edge creates a cycle")
+	ErrPayload      = errors.New("payload is not valid base64")
+	// A recorded change without the node or edge its kind needs
+	ErrMalformedChange = errors.New("change is malformed")
+)
+
+// MutationError is returned by the mutation API, Err is one of the Err*
+// values above.
+type MutationError struct {
+	Op  ChangeKind
+	ID  string
+	Err error
+}
+
+func (e *MutationError) Error() string {
+	if e.ID == "" {
+		return fmt.Sprintf("%s: %s", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %s", e.Op, e.ID, e.Err)
+}
+
+func (e *MutationError) Unwrap() error {
+	return e.Err
+}
+
+type ChangeKind string
+
+const (
+	ChangeAddNode       ChangeKind = "add_node"
+	ChangeRemoveNode    ChangeKind = "remove_node"
+	ChangeUpdatePayload ChangeKind = "update_payload"
+	ChangeAddEdge       ChangeKind = "add_edge"
+	ChangeRemoveEdge    ChangeKind = "remove_edge"
+)
+
+// Change is a single successful call of the mutation API.
+type Change struct {
+	Kind ChangeKind `json:"kind"`
+	// AddNode: the new node, RemoveNode: the removed node,
+	// UpdatePayload: the node after the update
+	Node *Node `json:"node,omitempty"`
+	// AddEdge, RemoveEdge
+	Edge *Edge `json:"edge,omitempty"`
+	// AddNode: the parents of the new node
+	Parents []string `json:"parents,omitempty"`
+	// UpdatePayload: the ID of the node before the update
+	PrevID string `json:"prev_id,omitempty"`
+}
+
+// Validate checks that the change has the Node or Edge its kind needs, as a
+// ChangeSet may come from outside of the mutation API, e.g. decoded JSON.
+func (c *Change) Validate() error {
+	switch c.Kind {
+	case ChangeAddNode, ChangeRemoveNode, ChangeUpdatePayload:
+		if c.Node == nil {
+			return &MutationError{Op: c.Kind, ID: c.PrevID, Err: ErrMalformedChange}
+		}
+	case ChangeAddEdge, ChangeRemoveEdge:
+		if c.Edge == nil {
+			return &MutationError{Op: c.Kind, Err: ErrMalformedChange}
+		}
+	default:
+		return fmt.Errorf("unknown change kind: %s", c.Kind)
+	}
+	return nil
+}
+
+// ChangeSet records the mutations applied on a DAG, in order.
+type ChangeSet []Change
+
+// Replay applies the changes on d, which is expected to be in the state the
+// recorded DAG was in before the first change. A malformed change fails with
+// ErrMalformedChange, leaving d with the changes before it applied.
+func (cs ChangeSet) Replay(d *DAG) error {
+	for _, c := range cs {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+
+		var err error
+		switch c.Kind {
+		case ChangeAddNode:
+			err = d.AddNode(*c.Node, c.Parents...)
+		case ChangeRemoveNode:
+			err = d.RemoveNode(c.Node.ID)
+		case ChangeUpdatePayload:
+			_, err = d.UpdatePayload(c.PrevID, c.Node.Payload)
+		case ChangeAddEdge:
+			err = d.AddEdge(c.Edge.From, c.Edge.To)
+		case ChangeRemoveEdge:
+			err = d.RemoveEdge(c.Edge.From, c.Edge.To)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TakeChanges returns the changes recorded since the last call and resets
+// the record.
+func (dag *DAG) TakeChanges() ChangeSet {
+	r := dag.Changes
+	dag.Changes = nil
+	return r
+}
+
+func (dag *DAG) findNode(id string) int {
+	for i, node := range dag.Nodes {
+		if node.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (dag *DAG) findEdge(from, to string) int {
+	for i, edge := range dag.Edges {
+		if edge.From == from && edge.To == to {
+			return i
+		}
+	}
+	return -1
+}
+
+func (dag *DAG) hasInDegree(id string) bool {
+	for _, edge := range dag.Edges {
+		if edge.To == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (dag *DAG) addSource(id string) {
+	for _, source := range dag.Sources {
+		if source.ID == id {
+			return
+		}
+	}
+	dag.Sources = append(dag.Sources, Source{
+		Name: "Source-" + id,
+		ID:   id,
+	})
+}
+
+func (dag *DAG) removeSource(id string) {
+	for i, source := range dag.Sources {
+		if source.ID == id {
+			dag.Sources = append(dag.Sources[:i], dag.Sources[i+1:]...)
+			return
+		}
+	}
+}
+
+// Whether to can be reached from from.
+func (dag *DAG) reachable(from, to string) bool {
+	graph := make(map[string][]string)
+	for _, edge := range dag.Edges {
+		graph[edge.From] = append(graph[edge.From], edge.To)
+	}
+
+	visited := map[string]struct{}{from: {}}
+	stack := []string{from}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if current == to {
+			return true
+		}
+
+		for _, next := range graph[current] {
+			if _, ok := visited[next]; ok {
+				continue
+			}
+			visited[next] = struct{}{}
+			stack = append(stack, next)
+		}
+	}
+
+	return false
+}
+
+// AddNode inserts node with an edge from each of parents, a node without
+// parents becomes a source.
+func (dag *DAG) AddNode(node Node, parents ...string) error {
+	if dag.findNode(node.ID) >= 0 {
+		return &MutationError{Op: ChangeAddNode, ID: node.ID, Err: ErrNodeExists}
+	}
+	seen := map[string]struct{}{}
+	for _, parent := range parents {
+		if parent == node.ID {
+			return &MutationError{Op: ChangeAddNode, ID: node.ID, Err: ErrSelfLoop}
+		}
+		if dag.findNode(parent) < 0 {
+			return &MutationError{Op: ChangeAddNode, ID: parent, Err: ErrNodeNotFound}
+		}
+		if _, ok := seen[parent]; ok {
+			return &MutationError{Op: ChangeAddNode, ID: parent, Err: ErrEdgeExists}
+		}
+		seen[parent] = struct{}{}
+	}
+
+	dag.Nodes = append(dag.Nodes, node)
+	for _, parent := range parents {
+		dag.Edges = append(dag.Edges, Edge{From: parent, To: node.ID})
+	}
+	if len(parents) == 0 {
+		dag.addSource(node.ID)
+	}
+
+	dag.Changes = append(dag.Changes, Change{
+		Kind:    ChangeAddNode,
+		Node:    &node,
+		Parents: append([]string(nil), parents...),
+	})
+	return nil
+}
+
+// RemoveNode deletes the node with id and connects each of its parents to
+// each of its children, so reachability between the remaining nodes is kept.
+// Children left without parents become sources.
+func (dag *DAG) RemoveNode(id string) error {
+	index := dag.findNode(id)
+	if index < 0 {
+		return &MutationError{Op: ChangeRemoveNode, ID: id, Err: ErrNodeNotFound}
+	}
+	node := dag.Nodes[index]
+
+	var parents, children []string
+	edges := dag.Edges[:0]
+	for _, edge := range dag.Edges {
+		switch id {
+		case edge.To:
+			parents = append(parents, edge.From)
+		case edge.From:
+			children = append(children, edge.To)
+		default:
+			edges = append(edges, edge)
+		}
+	}
+	dag.Edges = edges
+	dag.Nodes = append(dag.Nodes[:index], dag.Nodes[index+1:]...)
+	dag.removeSource(id)
+
+	for _, parent := range parents {
+		for _, child := range children {
+			if dag.findEdge(parent, child) < 0 {
+				dag.Edges = append(dag.Edges, Edge{From: parent, To: child})
+			}
+		}
+	}
+	for _, child := range children {
+		if !dag.hasInDegree(child) {
+			dag.addSource(child)
+		}
+	}
+
+	dag.Changes = append(dag.Changes, Change{
+		Kind: ChangeRemoveNode,
+		Node: &node,
+	})
+	return nil
+}
+
+// UpdatePayload replaces the payload of the node with id, the node is
+// renamed to the hash of the decoded payload and its edges and source are
+// moved along. Returns the new ID.
+func (dag *DAG) UpdatePayload(id string, payload string) (string, error) {
+	index := dag.findNode(id)
+	if index < 0 {
+		return "", &MutationError{Op: ChangeUpdatePayload, ID: id, Err: ErrNodeNotFound}
+	}
+
+	b, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", &MutationError{Op: ChangeUpdatePayload, ID: id, Err: ErrPayload}
+	}
+
+	newID := dag.Config.hashPayload(b)
+	if newID != id && dag.findNode(newID) >= 0 {
+		return "", &MutationError{Op: ChangeUpdatePayload, ID: newID, Err: ErrNodeExists}
+	}
+
+	node := &dag.Nodes[index]
+	node.ID = newID
+	node.Payload = payload
+
+	for i := range dag.Edges {
+		edge := &dag.Edges[i]
+		if edge.From == id {
+			edge.From = newID
+		}
+		if edge.To == id {
+			edge.To = newID
+		}
+	}
+	for i := range dag.Sources {
+		source := &dag.Sources[i]
+		if source.ID == id {
+			source.ID = newID
+		}
+	}
+
+	n := *node
+	dag.Changes = append(dag.Changes, Change{
+		Kind:   ChangeUpdatePayload,
+		Node:   &n,
+		PrevID: id,
+	})
+	return newID, nil
+}
+
+// AddEdge connects from to to, rejecting edges that would create a cycle.
+// to is no longer a source afterwards.
+func (dag *DAG) AddEdge(from, to string) error {
+	edge := Edge{From: from, To: to}
+	id := from + "->" + to
+
+	if from == to {
+		return &MutationError{Op: ChangeAddEdge, ID: id, Err: ErrSelfLoop}
+	}
+	if dag.findNode(from) < 0 {
+		return &MutationError{Op: ChangeAddEdge, ID: from, Err: ErrNodeNotFound}
+	}
+	if dag.findNode(to) < 0 {
+		return &MutationError{Op: ChangeAddEdge, ID: to, Err: ErrNodeNotFound}
+	}
+	if dag.findEdge(from, to) >= 0 {
+		return &MutationError{Op: ChangeAddEdge, ID: id, Err: ErrEdgeExists}
+	}
+	if dag.reachable(to, from) {
+		return &MutationError{Op: ChangeAddEdge, ID: id, Err: ErrCycle}
+	}
+
+	dag.Edges = append(dag.Edges, edge)
+	dag.removeSource(to)
+
+	dag.Changes = append(dag.Changes, Change{
+		Kind: ChangeAddEdge,
+		Edge: &edge,
+	})
+	return nil
+}
+
+// RemoveEdge disconnects from and to, to becomes a source if it has no
+// other parent left.
+func (dag *DAG) RemoveEdge(from, to string) error {
+	edge := Edge{From: from, To: to}
+
+	index := dag.findEdge(from, to)
+	if index < 0 {
+		return &MutationError{Op: ChangeRemoveEdge, ID: from + "->" + to, Err: ErrEdgeNotFound}
+	}
+
+	dag.Edges = append(dag.Edges[:index], dag.Edges[index+1:]...)
+	if !dag.hasInDegree(to) {
+		dag.addSource(to)
+	}
+
+	dag.Changes = append(dag.Changes, Change{
+		Kind: ChangeRemoveEdge,
+		Edge: &edge,
+	})
+	return nil
+}
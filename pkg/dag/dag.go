@@ -16,6 +16,8 @@ type DAG struct {
 	Edges   []Edge     `json:"edges"`
 	Sources []Source   `json:"sources"`
 	Config  *DAGConfig `json:"-"`
+	// Recorded by the mutation API, see TakeChanges
+	Changes ChangeSet `json:"-"`
 }
 
 type Node struct {
@@ -42,6 +44,38 @@ type DAGConfig struct {
 	RandomDegree int // Random ingoing and outgoing edges per node on generated & inserted nodes
 	// Default 100
 	PayloadSize int // Size of the payload for each node
+	// Default MD5
+	HashPayload func([]byte) string // ID of a node from its raw payload
+}
+
+func (config *DAGConfig) hashPayload(b []byte) string {
+	if config == nil || config.HashPayload == nil {
+		return generateMD5(b)
+	}
+	return config.HashPayload(b)
+}
+
+// The DAG's Config with the zero fields set to their default.
+func (dag *DAG) config() *DAGConfig {
+	config := defaultDAGConfig
+	if dag.Config == nil {
+		return &config
+	}
+
+	if dag.Config.NumNodes > 0 {
+		config.NumNodes = dag.Config.NumNodes
+	}
+	if dag.Config.NumSources > 0 {
+		config.NumSources = dag.Config.NumSources
+	}
+	if dag.Config.RandomDegree > 0 {
+		config.RandomDegree = dag.Config.RandomDegree
+	}
+	if dag.Config.PayloadSize > 0 {
+		config.PayloadSize = dag.Config.PayloadSize
+	}
+	config.HashPayload = dag.Config.HashPayload
+	return &config
 }
 
 var defaultDAGConfig = DAGConfig{
@@ -91,7 +125,7 @@ func GenerateRandomDAG(config *DAGConfig) *DAG {
 	for i := 0; i < config.NumNodes; i++ {
 		b := randomBase64Bytes(config.PayloadSize)
 		nodes[i] = Node{
-			ID:      generateMD5(b),
+			ID:      config.hashPayload(b),
 			Payload: base64.StdEncoding.EncodeToString(b),
 		}
 	}
@@ -119,12 +153,14 @@ func GenerateRandomDAG(config *DAGConfig) *DAG {
 		numEdges := mrand.Intn(config.RandomDegree)
 		for j := 0; j < numEdges; j++ {
 			target := mrand.Intn(len(nodes))
-			if target < i {
+			// Sources must not have in-degree, which is likely between the
+			// first nodes of a small DAG and fails IsDAG and Validate
+			if target < i && i >= config.NumSources {
 				edges = append(edges, Edge{
 					From: nodes[target].ID,
 					To:   nodes[i].ID,
 				})
-			} else if target > i {
+			} else if target > i && target >= config.NumSources {
 				edges = append(edges, Edge{
 					From: nodes[i].ID,
 					To:   nodes[target].ID,
@@ -168,6 +204,17 @@ func dedupEdges(edges *[]Edge) {
 	*edges = r
 }
 
+// Clone returns a copy of the DAG sharing only its Config, the recorded
+// Changes are left out.
+func (dag *DAG) Clone() *DAG {
+	return &DAG{
+		Nodes:   append([]Node(nil), dag.Nodes...),
+		Edges:   append([]Edge(nil), dag.Edges...),
+		Sources: append([]Source(nil), dag.Sources...),
+		Config:  dag.Config,
+	}
+}
+
 func SortDAG(dag *DAG) {
 	nodes := dag.Nodes
 	sort.Slice(nodes, func(i, j int) bool {
@@ -335,10 +382,7 @@ func topologicalSort(dag *DAG) {
 }
 
 func (dag *DAG) AddRandomNodes(times int) {
-	config := dag.Config
-	if config == nil {
-		config = &defaultDAGConfig
-	}
+	config := dag.config()
 
 	topologicalSort(dag)
 
@@ -346,7 +390,7 @@ func (dag *DAG) AddRandomNodes(times int) {
 		// 1. Generate new Node
 		b := randomBase64Bytes(config.PayloadSize)
 		newNode := Node{
-			ID:      generateMD5(b),
+			ID:      config.hashPayload(b),
 			Payload: base64.StdEncoding.EncodeToString(b),
 		}
 
@@ -471,10 +515,7 @@ func (dag *DAG) DeleteRandomNodes(times int) {
 }
 
 func (dag *DAG) UpdateRandomNodes(times int) {
-	config := dag.Config
-	if config == nil {
-		config = &defaultDAGConfig
-	}
+	config := dag.config()
 
 	if len(dag.Sources) >= len(dag.Nodes) {
 		panic("len(dag.Nodes) >= len(dag.Sources)")
@@ -489,7 +530,7 @@ func (dag *DAG) UpdateRandomNodes(times int) {
 		prevID := node.ID
 		v := randomBase64Bytes(config.PayloadSize)
 		node.Payload = base64.StdEncoding.EncodeToString(v)
-		node.ID = generateMD5(v)
+		node.ID = config.hashPayload(v)
 
 		for i := 0; i < len(dag.Edges); i++ {
 			edge := &dag.Edges[i]
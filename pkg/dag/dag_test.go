@@ -1,7 +1,12 @@
 package dag_test
 
 import (
+	"crypto/md5"
 	"dag-poll/pkg/dag"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
 	"testing"
 )
 
@@ -14,6 +19,16 @@ func TestCreateDAG(t *testing.T) {
 	}
 }
 
+// Random edges between sources are only likely with few nodes
+func TestCreateSmallDAG(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 8, NumSources: 4})
+		if problems := d.Validate(); len(problems) > 0 {
+			t.Fatalf("unexpected problems: %v", problems)
+		}
+	}
+}
+
 func TestAddRandomNodes(t *testing.T) {
 	for i := 0; i < 20; i++ {
 		d := dag.GenerateRandomDAG(nil)
@@ -43,3 +58,166 @@ func TestUpdateRandomNodes(t *testing.T) {
 		}
 	}
 }
+
+func TestMutations(t *testing.T) {
+	d := &dag.DAG{}
+	if err := d.AddNode(dag.Node{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddNode(dag.Node{ID: "b"}, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddNode(dag.Node{ID: "c"}, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := d.AddEdge("c", "a")
+	if !errors.Is(err, dag.ErrCycle) {
+		t.Errorf("expected ErrCycle, got: %v", err)
+	}
+	err = d.AddNode(dag.Node{ID: "d"}, "x")
+	if !errors.Is(err, dag.ErrNodeNotFound) {
+		t.Errorf("expected ErrNodeNotFound, got: %v", err)
+	}
+	err = d.RemoveEdge("a", "c")
+	if !errors.Is(err, dag.ErrEdgeNotFound) {
+		t.Errorf("expected ErrEdgeNotFound, got: %v", err)
+	}
+
+	if err := d.RemoveNode("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.IsDAG(); err != nil {
+		t.Errorf("not a DAG after RemoveNode, err: %s", err)
+	}
+
+	if err := d.RemoveEdge("a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Sources) != 2 {
+		t.Errorf("expected c to become a source, sources: %v", d.Sources)
+	}
+	if err := d.IsDAG(); err != nil {
+		t.Errorf("not a DAG after RemoveEdge, err: %s", err)
+	}
+}
+
+func TestReplayChanges(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+		replica := d.Clone()
+
+		a, b := d.Nodes[len(d.Nodes)-1].ID, d.Nodes[len(d.Nodes)-2].ID
+		if err := d.AddEdge(a, b); err != nil && !errors.Is(err, dag.ErrCycle) && !errors.Is(err, dag.ErrEdgeExists) {
+			t.Fatal(err)
+		}
+		if err := d.AddNode(dag.Node{ID: "new", Payload: "bmV3"}, a, b); err != nil {
+			t.Fatal(err)
+		}
+		newID, err := d.UpdatePayload("new", "dXBkYXRlZA==")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.RemoveNode(d.Nodes[len(d.Nodes)/2].ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.RemoveEdge(a, newID); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.IsDAG(); err != nil {
+			t.Fatalf("failed to mutate DAG, err: %s\n", err)
+		}
+
+		if err := d.TakeChanges().Replay(replica); err != nil {
+			t.Fatalf("failed to replay changes, err: %s\n", err)
+		}
+		if !dag.IsEquals(d, replica) {
+			t.Errorf("replayed DAG is not equal")
+		}
+	}
+}
+
+func TestReplayMalformed(t *testing.T) {
+	d := &dag.DAG{}
+	if err := d.AddNode(dag.Node{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kind := range []dag.ChangeKind{
+		dag.ChangeAddNode, dag.ChangeRemoveNode, dag.ChangeUpdatePayload,
+		dag.ChangeAddEdge, dag.ChangeRemoveEdge,
+	} {
+		err := dag.ChangeSet{{Kind: kind}}.Replay(d)
+		var mutationErr *dag.MutationError
+		if !errors.Is(err, dag.ErrMalformedChange) || !errors.As(err, &mutationErr) || mutationErr.Op != kind {
+			t.Errorf("expected ErrMalformedChange for %s, got: %v", kind, err)
+		}
+	}
+	if len(d.Nodes) != 1 {
+		t.Errorf("DAG changed by malformed changes")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 500})
+		if problems := d.Validate(); len(problems) > 0 {
+			t.Fatalf("unexpected problems: %v", problems)
+		}
+	}
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 20, NumSources: 1})
+	source := d.Sources[0].ID
+	// A chain of new nodes off the source, then broken
+	var chain []string
+	for i := 0; i < 3; i++ {
+		b := []byte(fmt.Sprint("node-", i))
+		node := dag.Node{ID: fmt.Sprintf("%x", md5.Sum(b)), Payload: base64.StdEncoding.EncodeToString(b)}
+		d.Nodes = append(d.Nodes, node)
+		chain = append(chain, node.ID)
+	}
+	d.Edges = append(d.Edges,
+		dag.Edge{From: source, To: chain[0]},
+		dag.Edge{From: chain[0], To: chain[1]},
+		dag.Edge{From: chain[1], To: chain[2]},
+		dag.Edge{From: chain[2], To: chain[0]},
+		dag.Edge{From: chain[1], To: chain[1]},
+		dag.Edge{From: chain[2], To: "unknown"},
+		dag.Edge{From: chain[2], To: source},
+	)
+	d.Nodes = append(d.Nodes, d.Nodes[1], dag.Node{ID: "orphan", Payload: "aGVsbG8="})
+
+	kinds := make(map[dag.ProblemKind][]dag.Problem)
+	for _, problem := range d.Validate() {
+		kinds[problem.Kind] = append(kinds[problem.Kind], problem)
+	}
+
+	expected := map[dag.ProblemKind]int{
+		dag.ProblemDuplicateNode: 1,
+		dag.ProblemUnknownNode:   1,
+		dag.ProblemSelfLoop:      1,
+		dag.ProblemSourceEdge:    1,
+		dag.ProblemOrphan:        1,
+		dag.ProblemPayload:       1,
+	}
+	for kind, n := range expected {
+		if len(kinds[kind]) != n {
+			t.Errorf("expected %d %s, got: %v", n, kind, kinds[kind])
+		}
+	}
+
+	// Both cycles go through chain[0], the one through the source too
+	cycles := kinds[dag.ProblemCycle]
+	if len(cycles) == 0 {
+		t.Fatalf("no cycle found")
+	}
+	for _, cycle := range cycles {
+		ids := cycle.IDs
+		if len(ids) < 3 || ids[0] != ids[len(ids)-1] {
+			t.Errorf("cycle is not a closed path: %v", ids)
+		}
+		if !slices.Contains(ids, chain[0]) {
+			t.Errorf("cycle does not go through %s: %v", chain[0], ids)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package dag
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+type ProblemKind string
+
+const (
+	ProblemDuplicateNode ProblemKind = "duplicate_node"
+	// An edge or a source referencing a node not in Nodes
+	ProblemUnknownNode ProblemKind = "unknown_node"
+	ProblemSelfLoop    ProblemKind = "self_loop"
+	ProblemCycle       ProblemKind = "cycle"
+	ProblemSourceEdge  ProblemKind = "source_with_parent"
+	// Not reachable from any source
+	ProblemOrphan ProblemKind = "orphan"
+	// The payload does not hash to the node ID, or is not valid base64
+	ProblemPayload ProblemKind = "payload_mismatch"
+)
+
+// Problem is a single inconsistency found by Validate.
+type Problem struct {
+	Kind ProblemKind `json:"kind"`
+	// The node, the two ends of an edge, or the path of a cycle ending with
+	// its first node
+	IDs     []string `json:"ids"`
+	Message string   `json:"message"`
+}
+
+// Validate returns every problem of the DAG, none if it is valid, unlike
+// IsDAG which stops at the first one. Payloads are hashed with
+// Config.HashPayload, MD5 by default.
+func (dag *DAG) Validate() []Problem {
+	var problems []Problem
+	add := func(kind ProblemKind, ids []string, format string, args ...any) {
+		problems = append(problems, Problem{Kind: kind, IDs: ids, Message: fmt.Sprintf(format, args...)})
+	}
+
+	config := dag.config()
+	count := make(map[string]int, len(dag.Nodes))
+	for _, node := range dag.Nodes {
+		count[node.ID]++
+		if count[node.ID] == 2 {
+			add(ProblemDuplicateNode, []string{node.ID}, "node %s is listed more than once", node.ID)
+		}
+
+		b, err := base64.StdEncoding.DecodeString(node.Payload)
+		if err != nil {
+			add(ProblemPayload, []string{node.ID}, "payload of node %s is not valid base64: %s", node.ID, err)
+			continue
+		}
+		if id := config.hashPayload(b); id != node.ID {
+			add(ProblemPayload, []string{node.ID}, "payload of node %s hashes to %s", node.ID, id)
+		}
+	}
+
+	isSource := make(map[string]bool, len(dag.Sources))
+	for _, source := range dag.Sources {
+		isSource[source.ID] = true
+		if count[source.ID] == 0 {
+			add(ProblemUnknownNode, []string{source.ID}, "source %s references unknown node %s", source.Name, source.ID)
+		}
+	}
+
+	graph := make(map[string][]string, len(dag.Nodes))
+	for _, edge := range dag.Edges {
+		ids := []string{edge.From, edge.To}
+		switch {
+		case count[edge.From] == 0:
+			add(ProblemUnknownNode, ids, "edge %s -> %s references unknown node %s", edge.From, edge.To, edge.From)
+		case count[edge.To] == 0:
+			add(ProblemUnknownNode, ids, "edge %s -> %s references unknown node %s", edge.From, edge.To, edge.To)
+		case edge.From == edge.To:
+			add(ProblemSelfLoop, ids, "edge %s -> %s is a self-loop", edge.From, edge.To)
+		default:
+			graph[edge.From] = append(graph[edge.From], edge.To)
+		}
+
+		if isSource[edge.To] {
+			add(ProblemSourceEdge, ids, "source %s has an incoming edge from %s", edge.To, edge.From)
+		}
+	}
+
+	for _, cycle := range findCycles(dag.Nodes, graph) {
+		add(ProblemCycle, cycle, "cycle %s", strings.Join(cycle, " -> "))
+	}
+
+	reachable := make(map[string]bool, len(dag.Nodes))
+	var stack []string
+	for _, source := range dag.Sources {
+		if count[source.ID] > 0 && !reachable[source.ID] {
+			reachable[source.ID] = true
+			stack = append(stack, source.ID)
+		}
+	}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, child := range graph[id] {
+			if !reachable[child] {
+				reachable[child] = true
+				stack = append(stack, child)
+			}
+		}
+	}
+	for _, node := range dag.Nodes {
+		if !reachable[node.ID] {
+			reachable[node.ID] = true
+			add(ProblemOrphan, []string{node.ID}, "node %s is not reachable from any source", node.ID)
+		}
+	}
+
+	return problems
+}
+
+// findCycles returns a cycle for every back edge found by a depth first
+// search of the graph, as the path from the first node back to it.
+func findCycles(nodes []Node, graph map[string][]string) [][]string {
+	const (
+		unvisited = iota
+		inPath
+		done
+	)
+	color := make(map[string]int, len(nodes))
+	var cycles [][]string
+
+	type frame struct {
+		id   string
+		next int
+	}
+	for _, node := range nodes {
+		if color[node.ID] != unvisited {
+			continue
+		}
+
+		color[node.ID] = inPath
+		path := []frame{{id: node.ID}}
+		for len(path) > 0 {
+			top := &path[len(path)-1]
+			children := graph[top.id]
+			if top.next == len(children) {
+				color[top.id] = done
+				path = path[:len(path)-1]
+				continue
+			}
+
+			child := children[top.next]
+			top.next++
+			switch color[child] {
+			case unvisited:
+				color[child] = inPath
+				path = append(path, frame{id: child})
+			case inPath:
+				var cycle []string
+				for i := len(path) - 1; i >= 0; i-- {
+					if path[i].id == child {
+						for _, f := range path[i:] {
+							cycle = append(cycle, f.id)
+						}
+						break
+					}
+				}
+				cycles = append(cycles, append(cycle, child))
+			}
+		}
+	}
+	return cycles
+}
@@ -0,0 +1,679 @@
+package merkledag
+
+import (
+	"dag-poll/pkg/dag"
+	"dag-poll/pkg/utils"
+	"fmt"
+)
+
+type index struct {
+	merkleIDs utils.Map[PayloadID, MerkleID]
+	parents   utils.Map[PayloadID, []PayloadID]
+}
+
+func newIndex(m *MerkleDAG) *index {
+	payloadIDs := make(map[MerkleID]PayloadID, m.MerkleGraph.Len())
+	r := &index{}
+	for _, source := range m.Sources {
+		payloadIDs[source.MerkleID] = source.PayloadID
+		r.merkleIDs.Set(source.PayloadID, source.MerkleID)
+	}
+	m.MerkleGraph.Range(func(_ MerkleID, nodes []*Node) bool {
+		for _, node := range nodes {
+			payloadIDs[node.MerkleID] = node.PayloadID
+			r.merkleIDs.Set(node.PayloadID, node.MerkleID)
+		}
+		return true
+	})
+
+	parents := make(map[PayloadID][]PayloadID, len(payloadIDs))
+	m.MerkleGraph.Range(func(merkleID MerkleID, nodes []*Node) bool {
+		from, ok := payloadIDs[merkleID]
+		if !ok {
+			return true
+		}
+		for _, node := range nodes {
+			parents[node.PayloadID] = append(parents[node.PayloadID], from)
+		}
+		return true
+	})
+	for payloadID, ids := range parents {
+		r.parents.Set(payloadID, ids)
+	}
+
+	return r
+}
+
+// Update replaces the node identified by From with To, keeping its edges.
+// If To.ID equals From only the payload is replaced.
+type Update struct {
+	From PayloadID
+	To   dag.Node
+}
+
+// ApplyChanges returns a new MerkleDAG with the changes applied on top of m,
+// only the changed nodes and their ancestors are rehashed. m is left
+// untouched, the new MerkleDAG shares the entries of all other nodes with it,
+// so the cost only depends on the size of the changes. Nodes no longer
+// reachable from a source are dropped, like GenerateMerkleDAG does.
+//
+// The changes are applied in this order:
+//  1. removed.Edges
+//  2. removed.Nodes, together with their remaining edges and sources
+//  3. removed.Sources
+//  4. updated
+//  5. added.Nodes
+//  6. added.Edges
+//  7. added.Sources
+//
+// Only the ID of removed nodes is used. added and removed may be nil.
+func (m *MerkleDAG) ApplyChanges(added, removed *dag.DAG, updated []Update) (*MerkleDAG, error) {
+	if added == nil {
+		added = &dag.DAG{}
+	}
+	if removed == nil {
+		removed = &dag.DAG{}
+	}
+
+	c := newChanges(m)
+
+	for _, edge := range removed.Edges {
+		if err := c.removeEdge(edge); err != nil {
+			return nil, err
+		}
+	}
+	for _, node := range removed.Nodes {
+		if err := c.removeNode(node.ID); err != nil {
+			return nil, err
+		}
+	}
+	for _, source := range removed.Sources {
+		c.removeSource(source.ID)
+	}
+	for _, u := range updated {
+		if err := c.update(u); err != nil {
+			return nil, err
+		}
+	}
+	for _, node := range added.Nodes {
+		if err := c.addNode(node); err != nil {
+			return nil, err
+		}
+	}
+	for _, edge := range added.Edges {
+		if err := c.addEdge(edge); err != nil {
+			return nil, err
+		}
+	}
+	for _, source := range added.Sources {
+		if err := c.addSource(source); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.build()
+}
+
+// ApplyChangeSet is ApplyChanges for the changes recorded by the dag mutation
+// API, replayed in order. A ChangeSet does not record the sources, they are
+// replaced by sources, the ones of the mutated DAG.
+func (m *MerkleDAG) ApplyChangeSet(cs dag.ChangeSet, sources []dag.Source) (*MerkleDAG, error) {
+	c := newChanges(m)
+
+	for _, change := range cs {
+		if err := c.replay(change); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.setSources(sources); err != nil {
+		return nil, err
+	}
+
+	return c.build()
+}
+
+type changes struct {
+	prev *MerkleDAG
+	// Index of prev, never modified
+	prevIndex *index
+
+	// Clones of the maps of prev
+	merkleIDs  utils.Map[PayloadID, MerkleID]
+	parents    utils.Map[PayloadID, []PayloadID]
+	payloadMap PayloadMap
+	sources    []Source
+
+	// Children of the touched nodes, other nodes keep the ones in prev
+	children map[PayloadID][]PayloadID
+	// Nodes whose Merkle ID has to be recomputed
+	dirty utils.Set[PayloadID]
+	// Merkle IDs to be dropped from the MerkleGraph
+	stale utils.Set[MerkleID]
+	// Nodes which lost a parent or a source, dropped by build if they are no
+	// longer reachable
+	orphans utils.Set[PayloadID]
+}
+
+func newChanges(m *MerkleDAG) *changes {
+	idx := m.index
+	if idx == nil {
+		idx = newIndex(m)
+	}
+
+	sources := make([]Source, len(m.Sources))
+	copy(sources, m.Sources)
+
+	return &changes{
+		prev:       m,
+		prevIndex:  idx,
+		merkleIDs:  idx.merkleIDs.Clone(),
+		parents:    idx.parents.Clone(),
+		payloadMap: m.PayloadMap.Clone(),
+		sources:    sources,
+		children:   make(map[PayloadID][]PayloadID),
+		dirty:      make(utils.Set[PayloadID]),
+		stale:      make(utils.Set[MerkleID]),
+		orphans:    make(utils.Set[PayloadID]),
+	}
+}
+
+func (c *changes) exists(payloadID PayloadID) bool {
+	return c.payloadMap.Has(payloadID)
+}
+
+func (c *changes) getChildren(payloadID PayloadID) []PayloadID {
+	if children, ok := c.children[payloadID]; ok {
+		return children
+	}
+
+	merkleID, ok := c.prevIndex.merkleIDs.Get(payloadID)
+	if !ok {
+		return nil
+	}
+
+	nodes := c.prev.Children(merkleID)
+	children := make([]PayloadID, 0, len(nodes))
+	for _, node := range nodes {
+		children = append(children, node.PayloadID)
+	}
+	return children
+}
+
+func (c *changes) getParents(payloadID PayloadID) []PayloadID {
+	r, _ := c.parents.Get(payloadID)
+	return r
+}
+
+// Slices are shared with prev, so they are never modified in place.
+func without(ids []PayloadID, id PayloadID) []PayloadID {
+	r := make([]PayloadID, 0, len(ids))
+	for _, v := range ids {
+		if v != id {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+func replace(ids []PayloadID, from, to PayloadID) []PayloadID {
+	r := make([]PayloadID, len(ids))
+	for i, v := range ids {
+		if v == from {
+			v = to
+		}
+		r[i] = v
+	}
+	return r
+}
+
+func contains(ids []PayloadID, id PayloadID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *changes) markStale(payloadID PayloadID) {
+	if merkleID, ok := c.merkleIDs.Get(payloadID); ok {
+		c.stale.Add(merkleID)
+	}
+}
+
+func (c *changes) removeEdge(edge dag.Edge) error {
+	children := c.getChildren(edge.From)
+	if !contains(children, edge.To) {
+		return fmt.Errorf("edge not found, from: %s, to: %s", edge.From, edge.To)
+	}
+
+	c.children[edge.From] = without(children, edge.To)
+	c.parents.Set(edge.To, without(c.getParents(edge.To), edge.From))
+	c.dirty.Add(edge.From)
+	c.orphans.Add(edge.To)
+	return nil
+}
+
+func (c *changes) removeNode(payloadID PayloadID) error {
+	if !c.exists(payloadID) {
+		return fmt.Errorf("node not found, id: %s", payloadID)
+	}
+
+	for _, parent := range c.getParents(payloadID) {
+		c.children[parent] = without(c.getChildren(parent), payloadID)
+		c.dirty.Add(parent)
+	}
+	c.drop(payloadID)
+	c.removeSource(payloadID)
+	return nil
+}
+
+// Remove a node without parents, its children become orphan candidates.
+func (c *changes) drop(payloadID PayloadID) {
+	for _, child := range c.getChildren(payloadID) {
+		c.parents.Set(child, without(c.getParents(child), payloadID))
+		c.orphans.Add(child)
+	}
+
+	c.markStale(payloadID)
+	c.merkleIDs.Delete(payloadID)
+	c.parents.Delete(payloadID)
+	delete(c.children, payloadID)
+	c.payloadMap.Delete(payloadID)
+	c.dirty.Remove(payloadID)
+}
+
+func (c *changes) removeSource(payloadID PayloadID) {
+	sources := c.sources[:0]
+	for _, source := range c.sources {
+		if source.PayloadID != payloadID {
+			sources = append(sources, source)
+		}
+	}
+	c.sources = sources
+	c.orphans.Add(payloadID)
+}
+
+func (c *changes) update(u Update) error {
+	if !c.exists(u.From) {
+		return fmt.Errorf("node not found, id: %s", u.From)
+	}
+
+	if u.From == u.To.ID {
+		// The Merkle ID only depends on the PayloadID
+		c.payloadMap.Set(u.From, u.To.Payload)
+		return nil
+	}
+
+	if c.exists(u.To.ID) {
+		return fmt.Errorf("node already exists, id: %s", u.To.ID)
+	}
+
+	children := c.getChildren(u.From)
+	parents := c.getParents(u.From)
+	for _, parent := range parents {
+		c.children[parent] = replace(c.getChildren(parent), u.From, u.To.ID)
+		c.dirty.Add(parent)
+	}
+	for _, child := range children {
+		c.parents.Set(child, replace(c.getParents(child), u.From, u.To.ID))
+	}
+
+	c.markStale(u.From)
+	c.merkleIDs.Delete(u.From)
+	c.parents.Delete(u.From)
+	delete(c.children, u.From)
+	c.payloadMap.Delete(u.From)
+	c.dirty.Remove(u.From)
+	if c.orphans.Contains(u.From) {
+		c.orphans.Add(u.To.ID)
+	}
+
+	c.children[u.To.ID] = children
+	if parents != nil {
+		c.parents.Set(u.To.ID, parents)
+	}
+	c.payloadMap.Set(u.To.ID, u.To.Payload)
+	c.dirty.Add(u.To.ID)
+
+	for i := range c.sources {
+		if c.sources[i].PayloadID == u.From {
+			c.sources[i].PayloadID = u.To.ID
+		}
+	}
+	return nil
+}
+
+func (c *changes) addNode(node dag.Node) error {
+	if c.exists(node.ID) {
+		return fmt.Errorf("node already exists, id: %s", node.ID)
+	}
+
+	c.children[node.ID] = nil
+	c.payloadMap.Set(node.ID, node.Payload)
+	c.dirty.Add(node.ID)
+	c.orphans.Add(node.ID)
+	return nil
+}
+
+func (c *changes) addEdge(edge dag.Edge) error {
+	if !c.exists(edge.From) {
+		return fmt.Errorf("node not found, id: %s", edge.From)
+	}
+	if !c.exists(edge.To) {
+		return fmt.Errorf("node not found, id: %s", edge.To)
+	}
+	if edge.From == edge.To {
+		return fmt.Errorf("self-loop on node, id: %s", edge.From)
+	}
+
+	children := c.getChildren(edge.From)
+	if contains(children, edge.To) {
+		return nil
+	}
+
+	c.children[edge.From] = append(children[:len(children):len(children)], edge.To)
+	parents := c.getParents(edge.To)
+	c.parents.Set(edge.To, append(parents[:len(parents):len(parents)], edge.From))
+	c.dirty.Add(edge.From)
+	return nil
+}
+
+func (c *changes) addSource(source dag.Source) error {
+	if !c.exists(source.ID) {
+		return fmt.Errorf("node not found, id: %s", source.ID)
+	}
+
+	c.sources = append(c.sources, Source{
+		Name:      source.Name,
+		PayloadID: source.ID,
+	})
+	return nil
+}
+
+func (c *changes) setSources(sources []dag.Source) error {
+	for _, source := range c.sources {
+		c.orphans.Add(source.PayloadID)
+	}
+
+	c.sources = make([]Source, 0, len(sources))
+	for _, source := range sources {
+		if err := c.addSource(source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply a change of the dag mutation API, with the same semantics.
+func (c *changes) replay(change dag.Change) error {
+	if err := change.Validate(); err != nil {
+		return err
+	}
+
+	switch change.Kind {
+	case dag.ChangeAddNode:
+		if err := c.addNode(*change.Node); err != nil {
+			return err
+		}
+		for _, parent := range change.Parents {
+			if err := c.addEdge(dag.Edge{From: parent, To: change.Node.ID}); err != nil {
+				return err
+			}
+		}
+	case dag.ChangeRemoveNode:
+		// The parents are connected to the children
+		id := change.Node.ID
+		parents, children := c.getParents(id), c.getChildren(id)
+		if err := c.removeNode(id); err != nil {
+			return err
+		}
+		for _, parent := range parents {
+			for _, child := range children {
+				if err := c.addEdge(dag.Edge{From: parent, To: child}); err != nil {
+					return err
+				}
+			}
+		}
+	case dag.ChangeUpdatePayload:
+		return c.update(Update{From: change.PrevID, To: *change.Node})
+	case dag.ChangeAddEdge:
+		return c.addEdge(*change.Edge)
+	case dag.ChangeRemoveEdge:
+		return c.removeEdge(*change.Edge)
+	}
+	return nil
+}
+
+// Drop the nodes left without parents which are not sources, then their
+// children left without parents in turn.
+func (c *changes) dropOrphans() {
+	sources := make(utils.Set[PayloadID], len(c.sources))
+	for _, source := range c.sources {
+		sources.Add(source.PayloadID)
+	}
+
+	queue := make([]PayloadID, 0, len(c.orphans))
+	for payloadID := range c.orphans {
+		queue = append(queue, payloadID)
+	}
+	for len(queue) > 0 {
+		payloadID := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if !c.exists(payloadID) || sources.Contains(payloadID) || len(c.getParents(payloadID)) > 0 {
+			continue
+		}
+
+		queue = append(queue, c.getChildren(payloadID)...)
+		c.drop(payloadID)
+	}
+}
+
+// Collect the dirty nodes and all their ancestors.
+func (c *changes) affected() utils.Set[PayloadID] {
+	r := make(utils.Set[PayloadID], len(c.dirty))
+	var queue []PayloadID
+	for payloadID := range c.dirty {
+		r.Add(payloadID)
+		queue = append(queue, payloadID)
+	}
+
+	for len(queue) > 0 {
+		payloadID := queue[0]
+		queue = queue[1:]
+
+		for _, parent := range c.getParents(payloadID) {
+			if r.Contains(parent) {
+				continue
+			}
+			r.Add(parent)
+			queue = append(queue, parent)
+		}
+	}
+
+	return r
+}
+
+type changeFrame struct {
+	payloadID PayloadID
+	pending   []PayloadID
+}
+
+// Recompute the Merkle IDs of the affected nodes, children first.
+func (c *changes) rehash() (map[MerkleID][]*Node, error) {
+	affected := c.affected()
+	fresh := make(map[MerkleID][]*Node, len(affected))
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	status := make(map[PayloadID]int, len(affected))
+
+	for payloadID := range affected {
+		if status[payloadID] == done {
+			continue
+		}
+
+		status[payloadID] = visiting
+		stack := []*changeFrame{{
+			payloadID: payloadID,
+			pending:   c.getChildren(payloadID),
+		}}
+
+		for len(stack) > 0 {
+			frame := stack[len(stack)-1]
+
+			if len(frame.pending) == 0 {
+				c.markStale(frame.payloadID)
+
+				children := c.getChildren(frame.payloadID)
+				seen := make(utils.Set[MerkleID], len(children))
+				nodes := make([]*Node, 0, len(children))
+				var ids []MerkleID
+				for _, child := range children {
+					merkleID, _ := c.merkleIDs.Get(child)
+					if seen.Contains(merkleID) {
+						continue
+					}
+					seen.Add(merkleID)
+					nodes = append(nodes, &Node{
+						MerkleID:  merkleID,
+						PayloadID: child,
+					})
+					ids = append(ids, merkleID)
+				}
+
+				merkleID := NodeMerkleID(c.prev.Hasher, frame.payloadID, ids)
+				c.merkleIDs.Set(frame.payloadID, merkleID)
+				fresh[merkleID] = nodes
+				status[frame.payloadID] = done
+				stack = stack[:len(stack)-1]
+				continue
+			}
+
+			lastIndex := len(frame.pending) - 1
+			next := frame.pending[lastIndex]
+			frame.pending = frame.pending[:lastIndex]
+			if !affected.Contains(next) {
+				continue
+			}
+
+			switch status[next] {
+			case done:
+				continue
+			case visiting:
+				return nil, fmt.Errorf("cycle detected on node, id: %s", next)
+			}
+
+			status[next] = visiting
+			stack = append(stack, &changeFrame{
+				payloadID: next,
+				pending:   c.getChildren(next),
+			})
+		}
+	}
+
+	return fresh, nil
+}
+
+func (c *changes) build() (*MerkleDAG, error) {
+	c.dropOrphans()
+
+	fresh, err := c.rehash()
+	if err != nil {
+		return nil, err
+	}
+
+	merkleGraph := c.prev.MerkleGraph.Clone()
+	for merkleID := range c.stale {
+		merkleGraph.Delete(merkleID)
+	}
+	for merkleID, nodes := range fresh {
+		merkleGraph.Set(merkleID, nodes)
+	}
+
+	for i := range c.sources {
+		c.sources[i].MerkleID, _ = c.merkleIDs.Get(c.sources[i].PayloadID)
+	}
+
+	r := &MerkleDAG{
+		RootMerkleID: generateRootMerkleID(c.prev.Hasher, c.sources),
+		MerkleGraph:  merkleGraph,
+		PayloadMap:   c.payloadMap,
+		Sources:      c.sources,
+		Hasher:       c.prev.Hasher,
+	}
+
+	r.index = &index{
+		merkleIDs: c.merkleIDs,
+		parents:   c.parents,
+	}
+	return r, nil
+}
+
+// DiffDAG computes the changes turning prev into next, in the form accepted
+// by ApplyChanges. A node keeping its ID with a new payload is reported as
+// updated.
+func DiffDAG(prev, next *dag.DAG) (added, removed *dag.DAG, updated []Update) {
+	added = &dag.DAG{}
+	removed = &dag.DAG{}
+
+	prevNodes := make(map[PayloadID]Payload, len(prev.Nodes))
+	for _, node := range prev.Nodes {
+		prevNodes[node.ID] = node.Payload
+	}
+	nextNodes := make(map[PayloadID]Payload, len(next.Nodes))
+	for _, node := range next.Nodes {
+		nextNodes[node.ID] = node.Payload
+		payload, ok := prevNodes[node.ID]
+		if !ok {
+			added.Nodes = append(added.Nodes, node)
+			continue
+		}
+		if payload != node.Payload {
+			updated = append(updated, Update{From: node.ID, To: node})
+		}
+	}
+	for _, node := range prev.Nodes {
+		if _, ok := nextNodes[node.ID]; !ok {
+			removed.Nodes = append(removed.Nodes, node)
+		}
+	}
+
+	prevEdges := make(utils.Set[dag.Edge], len(prev.Edges))
+	for _, edge := range prev.Edges {
+		prevEdges.Add(edge)
+	}
+	nextEdges := make(utils.Set[dag.Edge], len(next.Edges))
+	for _, edge := range next.Edges {
+		nextEdges.Add(edge)
+		if !prevEdges.Contains(edge) {
+			added.Edges = append(added.Edges, edge)
+		}
+	}
+	for edge := range prevEdges {
+		if !nextEdges.Contains(edge) {
+			removed.Edges = append(removed.Edges, edge)
+		}
+	}
+
+	prevSources := make(utils.Set[dag.Source], len(prev.Sources))
+	for _, source := range prev.Sources {
+		prevSources.Add(source)
+	}
+	nextSources := make(utils.Set[dag.Source], len(next.Sources))
+	for _, source := range next.Sources {
+		nextSources.Add(source)
+		if !prevSources.Contains(source) {
+			added.Sources = append(added.Sources, source)
+		}
+	}
+	for source := range prevSources {
+		if !nextSources.Contains(source) {
+			removed.Sources = append(removed.Sources, source)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,174 @@
+package merkledag
+
+import (
+	"dag-poll/pkg/dag"
+	"dag-poll/pkg/utils"
+	"sort"
+)
+
+// MerkleDiff is what changed between two MerkleDAGs, by the IDs of the DAG
+// nodes, which are their PayloadIDs.
+type MerkleDiff struct {
+	Added   []PayloadID
+	Removed []PayloadID
+	// In both, with their edges or any of their descendants changed
+	Updated []PayloadID
+
+	AddedEdges   []dag.Edge
+	RemovedEdges []dag.Edge
+
+	AddedSources   []Source
+	RemovedSources []Source
+}
+
+// IsEmpty is true if nothing changed.
+func (d *MerkleDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Updated) == 0 &&
+		len(d.AddedEdges) == 0 && len(d.RemovedEdges) == 0 &&
+		len(d.AddedSources) == 0 && len(d.RemovedSources) == 0
+}
+
+// Diff returns what changed from prev to next. Both are walked from their
+// sources, skipping the subgraphs with a MerkleID found in the other one,
+// which are identical, so only the changed nodes and their ancestors are
+// visited. Both must use the same Hasher.
+func Diff(prev, next *MerkleDAG) *MerkleDiff {
+	r := &MerkleDiff{}
+	if prev.RootMerkleID == next.RootMerkleID {
+		return r
+	}
+
+	prevNodes := changedNodes(prev, next)
+	nextNodes := changedNodes(next, prev)
+
+	for payloadID, merkleID := range nextNodes {
+		prevMerkleID, ok := prevNodes[payloadID]
+		if !ok {
+			r.Added = append(r.Added, payloadID)
+			for _, child := range next.Children(merkleID) {
+				r.AddedEdges = append(r.AddedEdges, dag.Edge{From: payloadID, To: child.PayloadID})
+			}
+			continue
+		}
+
+		r.Updated = append(r.Updated, payloadID)
+		prevChildren := make(utils.Set[PayloadID])
+		for _, child := range prev.Children(prevMerkleID) {
+			prevChildren.Add(child.PayloadID)
+		}
+		nextChildren := make(utils.Set[PayloadID])
+		for _, child := range next.Children(merkleID) {
+			nextChildren.Add(child.PayloadID)
+			if !prevChildren.Contains(child.PayloadID) {
+				r.AddedEdges = append(r.AddedEdges, dag.Edge{From: payloadID, To: child.PayloadID})
+			}
+		}
+		for child := range prevChildren {
+			if !nextChildren.Contains(child) {
+				r.RemovedEdges = append(r.RemovedEdges, dag.Edge{From: payloadID, To: child})
+			}
+		}
+	}
+
+	for payloadID, merkleID := range prevNodes {
+		if _, ok := nextNodes[payloadID]; ok {
+			continue
+		}
+		r.Removed = append(r.Removed, payloadID)
+		for _, child := range prev.Children(merkleID) {
+			r.RemovedEdges = append(r.RemovedEdges, dag.Edge{From: payloadID, To: child.PayloadID})
+		}
+	}
+
+	// By name and PayloadID, the MerkleID of a source changes with any of its
+	// descendants
+	type sourceKey struct{ name, payloadID string }
+	prevSources := make(utils.Set[sourceKey], len(prev.Sources))
+	for _, source := range prev.Sources {
+		prevSources.Add(sourceKey{source.Name, source.PayloadID})
+	}
+	nextSources := make(utils.Set[sourceKey], len(next.Sources))
+	for _, source := range next.Sources {
+		key := sourceKey{source.Name, source.PayloadID}
+		nextSources.Add(key)
+		if !prevSources.Contains(key) {
+			r.AddedSources = append(r.AddedSources, source)
+		}
+	}
+	for _, source := range prev.Sources {
+		if !nextSources.Contains(sourceKey{source.Name, source.PayloadID}) {
+			r.RemovedSources = append(r.RemovedSources, source)
+		}
+	}
+
+	r.sort()
+	return r
+}
+
+// Delta returns the Merkle nodes of next not in prev, and the payloads of
+// next not in prev, all an observer holding prev needs to build next. Like
+// Diff it only walks the subgraphs whose MerkleID is not in prev.
+func Delta(prev, next *MerkleDAG) (nodes MerkleGraph, payloads PayloadMap) {
+	if prev.RootMerkleID == next.RootMerkleID {
+		return
+	}
+
+	for payloadID, merkleID := range changedNodes(next, prev) {
+		nodes.Set(merkleID, next.Children(merkleID))
+		if prev.PayloadMap.Has(payloadID) {
+			continue
+		}
+		if payload, ok := next.PayloadMap.Get(payloadID); ok {
+			payloads.Set(payloadID, payload)
+		}
+	}
+	return
+}
+
+// changedNodes returns the nodes of m, by PayloadID, whose MerkleID is not in
+// other. Since a MerkleID covers all the descendants, the walk stops at the
+// ones other has.
+func changedNodes(m, other *MerkleDAG) map[PayloadID]MerkleID {
+	r := make(map[PayloadID]MerkleID)
+
+	var stack []Node
+	for _, source := range m.Sources {
+		stack = append(stack, Node{MerkleID: source.MerkleID, PayloadID: source.PayloadID})
+	}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if other.MerkleGraph.Has(node.MerkleID) {
+			continue
+		}
+		if _, ok := r[node.PayloadID]; ok {
+			continue
+		}
+		r[node.PayloadID] = node.MerkleID
+
+		for _, child := range m.Children(node.MerkleID) {
+			stack = append(stack, *child)
+		}
+	}
+	return r
+}
+
+func (d *MerkleDiff) sort() {
+	for _, ids := range [][]PayloadID{d.Added, d.Removed, d.Updated} {
+		sort.Strings(ids)
+	}
+	for _, edges := range [][]dag.Edge{d.AddedEdges, d.RemovedEdges} {
+		sort.Slice(edges, func(i, j int) bool {
+			if edges[i].From != edges[j].From {
+				return edges[i].From < edges[j].From
+			}
+			return edges[i].To < edges[j].To
+		})
+	}
+	for _, sources := range [][]Source{d.AddedSources, d.RemovedSources} {
+		sort.Slice(sources, func(i, j int) bool {
+			return sources[i].PayloadID < sources[j].PayloadID
+		})
+	}
+}
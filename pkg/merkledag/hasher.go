@@ -0,0 +1,133 @@
+package merkledag
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+
+	"github.com/zeebo/blake3"
+)
+
+// Hasher is the hash function used for Merkle, root and payload IDs. Its
+// Name is advertised to observers, which must use the same one.
+type Hasher interface {
+	Name() string
+	New() hash.Hash
+}
+
+type hasher struct {
+	name string
+	new  func() hash.Hash
+}
+
+func (h *hasher) Name() string {
+	return h.name
+}
+
+func (h *hasher) New() hash.Hash {
+	return h.new()
+}
+
+// NewHasher wraps a hash.Hash constructor into a Hasher.
+func NewHasher(name string, new func() hash.Hash) Hasher {
+	return &hasher{name: name, new: new}
+}
+
+var (
+	// MD5 keeps the PayloadIDs of existing DAGs valid
+	MD5    = NewHasher("md5", md5.New)
+	SHA256 = NewHasher("sha256", sha256.New)
+	BLAKE3 = NewHasher("blake3", func() hash.Hash { return blake3.New() })
+
+	DefaultHasher = MD5
+)
+
+// HasherByName returns one of the built-in hashers, an empty name is the
+// DefaultHasher.
+func HasherByName(name string) (Hasher, error) {
+	switch name {
+	case "":
+		return DefaultHasher, nil
+	case MD5.Name():
+		return MD5, nil
+	case SHA256.Name():
+		return SHA256, nil
+	case BLAKE3.Name():
+		return BLAKE3, nil
+	}
+
+	return nil, fmt.Errorf("unknown hash function: %s", name)
+}
+
+func hasherOrDefault(h Hasher) Hasher {
+	if h == nil {
+		return DefaultHasher
+	}
+	return h
+}
+
+// Domain tags, a node and a root never hash the same input.
+const (
+	nodeDomain byte = 0x00
+	rootDomain byte = 0x01
+)
+
+// Every field is prefixed with its length, so IDs can not be shifted from one
+// field into the next.
+func writeField(h hash.Hash, s string) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(len(s)))
+	h.Write(b[:n])
+	h.Write([]byte(s))
+}
+
+func writeIDs(h hash.Hash, ids []string) {
+	sorted := make([]string, len(ids))
+	copy(sorted, ids)
+	sort.Strings(sorted)
+
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(len(sorted)))
+	h.Write(b[:n])
+	for _, id := range sorted {
+		writeField(h, id)
+	}
+}
+
+// NodeMerkleID is the MerkleID of the node with the payloadID and the
+// children, the order of children does not matter.
+func NodeMerkleID(hasher Hasher, payloadID PayloadID, children []MerkleID) MerkleID {
+	h := hasherOrDefault(hasher).New()
+	h.Write([]byte{nodeDomain})
+	writeField(h, payloadID)
+	writeIDs(h, children)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// RootMerkleID is the root of a MerkleDAG with the sources, the order of
+// sources does not matter.
+func RootMerkleID(hasher Hasher, sources []MerkleID) MerkleID {
+	h := hasherOrDefault(hasher).New()
+	h.Write([]byte{rootDomain})
+	writeIDs(h, sources)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HashPayload is the PayloadID of the raw, not base64 encoded, payload. It is
+// the plain digest, so IDs can be checked with any standard tool.
+func HashPayload(hasher Hasher, payload []byte) PayloadID {
+	h := hasherOrDefault(hasher).New()
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// PayloadHashFunc adapts the hasher to dag.DAGConfig.HashPayload.
+func PayloadHashFunc(hasher Hasher) func([]byte) string {
+	return func(b []byte) string {
+		return HashPayload(hasher, b)
+	}
+}
@@ -0,0 +1,121 @@
+package merkledag
+
+import (
+	"sync"
+	"time"
+)
+
+// History keeps the last published MerkleDAGs addressable by their root, so
+// a sync started against an older root can go on after a new publish.
+// Snapshots made by ApplyChanges share their untouched entries, so keeping
+// them is cheaper than keeping full copies.
+type History struct {
+	rw sync.RWMutex
+	// Max number of snapshots kept, the latest one included
+	size int
+	// Snapshots older than ttl are dropped, the latest one is always kept.
+	// Zero disables the expiration.
+	ttl time.Duration
+
+	// Oldest first
+	snapshots []snapshot
+}
+
+type snapshot struct {
+	merkleDAG   *MerkleDAG
+	publishedAt time.Time
+}
+
+func NewHistory(size int, ttl time.Duration) *History {
+	if size < 1 {
+		size = 1
+	}
+
+	return &History{
+		size: size,
+		ttl:  ttl,
+	}
+}
+
+// Push makes m the latest snapshot.
+func (h *History) Push(m *MerkleDAG) {
+	h.rw.Lock()
+	defer h.rw.Unlock()
+
+	snapshots := h.snapshots[:0]
+	for _, s := range h.snapshots {
+		if s.merkleDAG.RootMerkleID != m.RootMerkleID {
+			snapshots = append(snapshots, s)
+		}
+	}
+	h.snapshots = append(snapshots, snapshot{
+		merkleDAG:   m,
+		publishedAt: time.Now(),
+	})
+
+	h.expire()
+}
+
+func (h *History) expire() {
+	start := 0
+	if len(h.snapshots) > h.size {
+		start = len(h.snapshots) - h.size
+	}
+	if h.ttl > 0 {
+		deadline := time.Now().Add(-h.ttl)
+		for start < len(h.snapshots)-1 && h.snapshots[start].publishedAt.Before(deadline) {
+			start++
+		}
+	}
+
+	if start == 0 {
+		return
+	}
+	// Do not keep the dropped snapshots alive through the backing array
+	snapshots := make([]snapshot, len(h.snapshots)-start)
+	copy(snapshots, h.snapshots[start:])
+	h.snapshots = snapshots
+}
+
+// Latest returns the last pushed MerkleDAG, nil if there is none.
+func (h *History) Latest() *MerkleDAG {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+
+	if len(h.snapshots) == 0 {
+		return nil
+	}
+	return h.snapshots[len(h.snapshots)-1].merkleDAG
+}
+
+// Get returns the snapshot with the root, nil if it is unknown or expired.
+func (h *History) Get(root MerkleID) *MerkleDAG {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+
+	latest := len(h.snapshots) - 1
+	for i := latest; i >= 0; i-- {
+		s := h.snapshots[i]
+		if s.merkleDAG.RootMerkleID != root {
+			continue
+		}
+		if i != latest && h.ttl > 0 && time.Since(s.publishedAt) > h.ttl {
+			return nil
+		}
+		return s.merkleDAG
+	}
+
+	return nil
+}
+
+// Snapshots returns the MerkleDAGs still kept, oldest first.
+func (h *History) Snapshots() []*MerkleDAG {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+
+	r := make([]*MerkleDAG, len(h.snapshots))
+	for i, s := range h.snapshots {
+		r[i] = s.merkleDAG
+	}
+	return r
+}
@@ -4,8 +4,6 @@ import (
 	"dag-poll/pkg/dag"
 	"dag-poll/pkg/utils"
 	"fmt"
-	"sort"
-	"time"
 )
 
 type MerkleID = string
@@ -23,15 +21,27 @@ type Node struct {
 	PayloadID PayloadID
 }
 
-type MerkleGraph map[MerkleID][]*Node
-type PayloadMap map[PayloadID]Payload
+// The maps of a MerkleDAG are persistent, a MerkleDAG made by ApplyChanges
+// shares all untouched entries with the one it was applied on.
+type MerkleGraph = utils.Map[MerkleID, []*Node]
+type PayloadMap = utils.Map[PayloadID, Payload]
 
 type MerkleDAG struct {
-	Version      int64
+	// Sequence number assigned once by the observable publishing the
+	// MerkleDAG, increasing with every new root, 0 until published
+	Version int64
+	// Unix time the Version was assigned at
+	Timestamp    int64
 	RootMerkleID string
 	MerkleGraph  MerkleGraph
 	PayloadMap   PayloadMap
 	Sources      []Source
+	// Hash function of the Merkle IDs, nil is the DefaultHasher
+	Hasher Hasher
+
+	// Payload level adjacency, used by ApplyChanges to find the ancestors of
+	// changed nodes without walking the whole graph.
+	index *index
 }
 
 type StackFrame struct {
@@ -40,32 +50,41 @@ type StackFrame struct {
 	pending   []PayloadID
 }
 
-func (s *StackFrame) getMerkleID() MerkleID {
-	var merkleIDs []string
-	// Current PayloadID
-	merkleIDs = append(merkleIDs, s.payloadID)
-	// All MerkleIDs
+func (s *StackFrame) getMerkleID(h Hasher) MerkleID {
+	merkleIDs := make([]MerkleID, 0, len(s.done))
 	for merkleID := range s.done {
 		merkleIDs = append(merkleIDs, merkleID)
 	}
 
-	sort.Strings(merkleIDs)
-	return utils.GenerateMD5(merkleIDs)
+	return NodeMerkleID(h, s.payloadID, merkleIDs)
 }
 
-func (s *StackFrame) getNode() *Node {
+func generateRootMerkleID(h Hasher, sources []Source) MerkleID {
+	var merkleIDs []string
+	for _, source := range sources {
+		merkleIDs = append(merkleIDs, source.MerkleID)
+	}
+	return RootMerkleID(h, merkleIDs)
+}
+
+func (s *StackFrame) getNode(h Hasher) *Node {
 	return &Node{
-		MerkleID:  s.getMerkleID(),
+		MerkleID:  s.getMerkleID(h),
 		PayloadID: s.payloadID,
 	}
 }
 
-func GenerateMerkleDAG(d *dag.DAG, abort chan struct{}) (r *MerkleDAG) {
+// GenerateMerkleDAG hashes the whole d, a nil hasher is the DefaultHasher.
+func GenerateMerkleDAG(d *dag.DAG, hasher Hasher, abort chan struct{}) (r *MerkleDAG) {
+	hasher = hasherOrDefault(hasher)
+
 	payloadGraph := make(map[PayloadID][]PayloadID, len(d.Nodes))
-	payloadMap := make(PayloadMap, len(d.Nodes))
+	payloads := make(map[PayloadID]Payload, len(d.Nodes))
+	// Only the payloads of nodes reachable from a source
+	var payloadMap PayloadMap
 
 	for _, node := range d.Nodes {
-		payloadMap[node.ID] = node.Payload
+		payloads[node.ID] = node.Payload
 	}
 	for _, edge := range d.Edges {
 		payloadGraph[edge.From] = append(payloadGraph[edge.From], edge.To)
@@ -73,7 +92,7 @@ func GenerateMerkleDAG(d *dag.DAG, abort chan struct{}) (r *MerkleDAG) {
 
 	sources := make([]Source, 0, len(d.Sources))
 	visited := make(map[PayloadID]MerkleID, len(d.Nodes))
-	merkleGraph := make(MerkleGraph, len(d.Nodes))
+	var merkleGraph MerkleGraph
 
 	for _, source := range d.Sources {
 		var stack []*StackFrame
@@ -88,7 +107,7 @@ func GenerateMerkleDAG(d *dag.DAG, abort chan struct{}) (r *MerkleDAG) {
 			frame := stack[len(stack)-1]
 
 			if len(frame.pending) == 0 {
-				node := frame.getNode()
+				node := frame.getNode(hasher)
 				visited[node.PayloadID] = node.MerkleID
 				nodes := make([]*Node, 0, len(frame.done))
 				for merkleID, payloadID := range frame.done {
@@ -97,7 +116,10 @@ func GenerateMerkleDAG(d *dag.DAG, abort chan struct{}) (r *MerkleDAG) {
 						PayloadID: payloadID,
 					})
 				}
-				merkleGraph[node.MerkleID] = nodes
+				merkleGraph.Set(node.MerkleID, nodes)
+				if payload, ok := payloads[node.PayloadID]; ok {
+					payloadMap.Set(node.PayloadID, payload)
+				}
 
 				if len(stack) == 1 {
 					stack = stack[:0]
@@ -145,23 +167,32 @@ func GenerateMerkleDAG(d *dag.DAG, abort chan struct{}) (r *MerkleDAG) {
 		})
 	}
 
-	var merkleIDs []string
-	for _, source := range sources {
-		merkleIDs = append(merkleIDs, source.MerkleID)
-	}
-	sort.Strings(merkleIDs)
-	rootMerkleID := utils.GenerateMD5(merkleIDs)
+	rootMerkleID := generateRootMerkleID(hasher, sources)
 
 	r = &MerkleDAG{
-		Version:      time.Now().Unix(),
 		RootMerkleID: rootMerkleID,
 		MerkleGraph:  merkleGraph,
 		PayloadMap:   payloadMap,
 		Sources:      sources,
+		Hasher:       hasher,
 	}
+	r.index = newIndex(r)
 	return
 }
 
+// Children returns the children of the node with the MerkleID, nil if it is
+// not in the MerkleGraph.
+func (m *MerkleDAG) Children(merkleID MerkleID) []*Node {
+	r, _ := m.MerkleGraph.Get(merkleID)
+	return r
+}
+
+// GetHasher returns the hash function of the Merkle IDs, the DefaultHasher
+// if none is set.
+func (m *MerkleDAG) GetHasher() Hasher {
+	return hasherOrDefault(m.Hasher)
+}
+
 func (m *MerkleDAG) ToDAG() *dag.DAG {
 	var sources []dag.Source
 	for _, source := range m.Sources {
@@ -172,22 +203,28 @@ func (m *MerkleDAG) ToDAG() *dag.DAG {
 		sources = append(sources, s)
 	}
 
+	payload := func(payloadID PayloadID) Payload {
+		r, _ := m.PayloadMap.Get(payloadID)
+		return r
+	}
+
 	nodeMap := make(map[PayloadID]dag.Node)
-	merkleIDToPayloadID := make(map[MerkleID]PayloadID, len(m.MerkleGraph))
-	for _, items := range m.MerkleGraph {
+	merkleIDToPayloadID := make(map[MerkleID]PayloadID, m.MerkleGraph.Len())
+	m.MerkleGraph.Range(func(_ MerkleID, items []*Node) bool {
 		for _, item := range items {
 			nodeMap[item.PayloadID] = dag.Node{
 				ID:      item.PayloadID,
-				Payload: m.PayloadMap[item.PayloadID],
+				Payload: payload(item.PayloadID),
 			}
 			merkleIDToPayloadID[item.MerkleID] = item.PayloadID
 		}
-	}
+		return true
+	})
 
 	for _, source := range m.Sources {
 		nodeMap[source.PayloadID] = dag.Node{
 			ID:      source.PayloadID,
-			Payload: m.PayloadMap[source.PayloadID],
+			Payload: payload(source.PayloadID),
 		}
 		merkleIDToPayloadID[source.MerkleID] = source.PayloadID
 	}
@@ -198,14 +235,15 @@ func (m *MerkleDAG) ToDAG() *dag.DAG {
 	}
 
 	var edges []dag.Edge
-	for merkleID, items := range m.MerkleGraph {
+	m.MerkleGraph.Range(func(merkleID MerkleID, items []*Node) bool {
 		for _, item := range items {
 			edges = append(edges, dag.Edge{
 				From: merkleIDToPayloadID[merkleID],
 				To:   item.PayloadID,
 			})
 		}
-	}
+		return true
+	})
 
 	d := &dag.DAG{
 		Nodes:   nodes,
@@ -0,0 +1,407 @@
+package merkledag_test
+
+import (
+	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+func assertSameMerkleDAG(t *testing.T, expected, actual *mkdag.MerkleDAG) {
+	t.Helper()
+
+	if expected.RootMerkleID != actual.RootMerkleID {
+		t.Fatalf("root not match, expected: %s, actual: %s", expected.RootMerkleID, actual.RootMerkleID)
+	}
+	if expected.MerkleGraph.Len() != actual.MerkleGraph.Len() {
+		t.Fatalf("len(MerkleGraph) not match, expected: %d, actual: %d", expected.MerkleGraph.Len(), actual.MerkleGraph.Len())
+	}
+	expected.MerkleGraph.Range(func(merkleID mkdag.MerkleID, nodes []*mkdag.Node) bool {
+		v, ok := actual.MerkleGraph.Get(merkleID)
+		if !ok || len(v) != len(nodes) {
+			t.Fatalf("MerkleGraph not match, merkle_id: %s", merkleID)
+		}
+		return true
+	})
+	if expected.PayloadMap.Len() != actual.PayloadMap.Len() {
+		t.Fatalf("len(PayloadMap) not match, expected: %d, actual: %d", expected.PayloadMap.Len(), actual.PayloadMap.Len())
+	}
+	expected.PayloadMap.Range(func(payloadID mkdag.PayloadID, payload mkdag.Payload) bool {
+		if v, _ := actual.PayloadMap.Get(payloadID); v != payload {
+			t.Fatalf("PayloadMap not match, payload_id: %s", payloadID)
+		}
+		return true
+	})
+}
+
+func TestApplyChanges(t *testing.T) {
+	mutations := []func(*dag.DAG){
+		func(d *dag.DAG) { d.AddRandomNodes(10) },
+		func(d *dag.DAG) { d.DeleteRandomNodes(10) },
+		func(d *dag.DAG) { d.UpdateRandomNodes(10) },
+	}
+
+	for i := 0; i < 20; i++ {
+		prev := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 500})
+		m := mkdag.GenerateMerkleDAG(prev, nil, nil)
+
+		next := prev.Clone()
+		mutations[i%len(mutations)](next)
+
+		v, err := m.ApplyChanges(mkdag.DiffDAG(prev, next))
+		if err != nil {
+			t.Fatalf("failed to apply changes, err: %s\n", err)
+		}
+
+		assertSameMerkleDAG(t, mkdag.GenerateMerkleDAG(next, nil, nil), v)
+		// The previous MerkleDAG must not be touched
+		assertSameMerkleDAG(t, mkdag.GenerateMerkleDAG(prev, nil, nil), m)
+	}
+}
+
+func TestApplyChangesPayload(t *testing.T) {
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	m := mkdag.GenerateMerkleDAG(d, nil, nil)
+
+	node := d.Nodes[0]
+	v, err := m.ApplyChanges(nil, nil, []mkdag.Update{{
+		From: node.ID,
+		To:   dag.Node{ID: node.ID, Payload: "updated"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.RootMerkleID != m.RootMerkleID {
+		t.Errorf("root should not change when only the payload changes")
+	}
+	if payload, _ := v.PayloadMap.Get(node.ID); payload != "updated" {
+		t.Errorf("payload not updated")
+	}
+	if payload, _ := m.PayloadMap.Get(node.ID); payload != node.Payload {
+		t.Errorf("previous payload should not change")
+	}
+}
+
+func TestApplyChangeSet(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+		m := mkdag.GenerateMerkleDAG(d, nil, nil)
+
+		a, b := d.Nodes[len(d.Nodes)-1].ID, d.Nodes[len(d.Nodes)-2].ID
+		if err := d.AddEdge(a, b); err != nil && !errors.Is(err, dag.ErrCycle) && !errors.Is(err, dag.ErrEdgeExists) {
+			t.Fatal(err)
+		}
+		if err := d.AddNode(dag.Node{ID: "new", Payload: "bmV3"}, a, b); err != nil {
+			t.Fatal(err)
+		}
+		newID, err := d.UpdatePayload("new", "dXBkYXRlZA==")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.RemoveNode(d.Nodes[i].ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.RemoveEdge(a, newID); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := m.ApplyChangeSet(d.TakeChanges(), d.Sources)
+		if err != nil {
+			t.Fatalf("failed to apply changes, err: %s\n", err)
+		}
+		assertSameMerkleDAG(t, mkdag.GenerateMerkleDAG(d, nil, nil), v)
+	}
+}
+
+func TestApplyChangesOrphans(t *testing.T) {
+	d := &dag.DAG{
+		Nodes:   []dag.Node{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d"}},
+		Edges:   []dag.Edge{{From: "a", To: "b"}, {From: "b", To: "c"}, {From: "a", To: "d"}},
+		Sources: []dag.Source{{Name: "a", ID: "a"}},
+	}
+	m := mkdag.GenerateMerkleDAG(d, nil, nil)
+
+	// b and c are no longer reachable
+	removed := &dag.DAG{Edges: []dag.Edge{{From: "a", To: "b"}}}
+	v, err := m.ApplyChanges(nil, removed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Edges = d.Edges[1:]
+	assertSameMerkleDAG(t, mkdag.GenerateMerkleDAG(d, nil, nil), v)
+	for _, id := range []string{"b", "c"} {
+		if v.PayloadMap.Has(id) {
+			t.Errorf("orphan not dropped, id: %s", id)
+		}
+	}
+}
+
+func TestApplyChangesCycle(t *testing.T) {
+	d := &dag.DAG{
+		Nodes:   []dag.Node{{ID: "a"}, {ID: "b"}, {ID: "c"}},
+		Edges:   []dag.Edge{{From: "a", To: "b"}, {From: "b", To: "c"}},
+		Sources: []dag.Source{{Name: "a", ID: "a"}},
+	}
+	m := mkdag.GenerateMerkleDAG(d, nil, nil)
+
+	added := &dag.DAG{Edges: []dag.Edge{{From: "c", To: "b"}}}
+	if _, err := m.ApplyChanges(added, nil, nil); err == nil {
+		t.Errorf("expected cycle error")
+	}
+
+	added = &dag.DAG{Edges: []dag.Edge{{From: "c", To: "x"}}}
+	if _, err := m.ApplyChanges(added, nil, nil); err == nil {
+		t.Errorf("expected unknown node error")
+	}
+}
+
+func TestHashers(t *testing.T) {
+	prev := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 300})
+	next := prev.Clone()
+	next.UpdateRandomNodes(10)
+
+	roots := make(map[mkdag.MerkleID]string)
+	for _, hasher := range []mkdag.Hasher{mkdag.MD5, mkdag.SHA256, mkdag.BLAKE3} {
+		m := mkdag.GenerateMerkleDAG(prev, hasher, nil)
+		if name, ok := roots[m.RootMerkleID]; ok {
+			t.Fatalf("%s and %s have the same root", name, hasher.Name())
+		}
+		roots[m.RootMerkleID] = hasher.Name()
+
+		v, err := m.ApplyChanges(mkdag.DiffDAG(prev, next))
+		if err != nil {
+			t.Fatalf("failed to apply changes, hash: %s, err: %s\n", hasher.Name(), err)
+		}
+		assertSameMerkleDAG(t, mkdag.GenerateMerkleDAG(next, hasher, nil), v)
+	}
+}
+
+func TestVerifyDAG(t *testing.T) {
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 50})
+	if err := mkdag.VerifyDAG(mkdag.MD5, d); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// MD5 node IDs, hashed with another function
+	var verifyErr *mkdag.VerifyError
+	if err := mkdag.VerifyDAG(mkdag.SHA256, d); !errors.As(err, &verifyErr) {
+		t.Errorf("expected a payload verification error, err: %v", err)
+	}
+}
+
+func TestMerkleIDEncoding(t *testing.T) {
+	h := mkdag.SHA256
+
+	if mkdag.NodeMerkleID(h, "p", []mkdag.MerkleID{"a", "b"}) != mkdag.NodeMerkleID(h, "p", []mkdag.MerkleID{"b", "a"}) {
+		t.Errorf("order of children changes the MerkleID")
+	}
+	if mkdag.NodeMerkleID(h, "ab", []mkdag.MerkleID{"c"}) == mkdag.NodeMerkleID(h, "a", []mkdag.MerkleID{"bc"}) {
+		t.Errorf("fields are not separated")
+	}
+	if mkdag.NodeMerkleID(h, "", nil) == mkdag.RootMerkleID(h, nil) {
+		t.Errorf("node and root are not domain separated")
+	}
+
+	if _, err := mkdag.HasherByName("sha1"); err == nil {
+		t.Errorf("expected unknown hash function")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	m := mkdag.GenerateMerkleDAG(d, nil, nil)
+
+	var sources []mkdag.MerkleID
+	for _, source := range m.Sources {
+		sources = append(sources, source.MerkleID)
+	}
+	if err := mkdag.VerifyRoot(m.Hasher, m.RootMerkleID, sources); err != nil {
+		t.Errorf("root, err: %s", err)
+	}
+
+	var nodes []mkdag.Node
+	for _, source := range m.Sources {
+		nodes = append(nodes, mkdag.Node{MerkleID: source.MerkleID, PayloadID: source.PayloadID})
+	}
+	m.MerkleGraph.Range(func(_ mkdag.MerkleID, children []*mkdag.Node) bool {
+		for _, child := range children {
+			nodes = append(nodes, *child)
+		}
+		return true
+	})
+	for _, node := range nodes {
+		var children []mkdag.MerkleID
+		for _, child := range m.Children(node.MerkleID) {
+			children = append(children, child.MerkleID)
+		}
+		if err := mkdag.VerifyNode(m.Hasher, node.MerkleID, node.PayloadID, children); err != nil {
+			t.Fatalf("node, err: %s", err)
+		}
+		payload, _ := m.PayloadMap.Get(node.PayloadID)
+		if err := mkdag.VerifyPayload(m.Hasher, node.PayloadID, payload); err != nil {
+			t.Fatalf("payload, err: %s", err)
+		}
+	}
+
+	node := nodes[0]
+	var verifyErr *mkdag.VerifyError
+	err := mkdag.VerifyNode(m.Hasher, node.MerkleID, node.PayloadID, []mkdag.MerkleID{"forged"})
+	if !errors.As(err, &verifyErr) || verifyErr.ID != node.MerkleID {
+		t.Errorf("expected forged children to fail, err: %v", err)
+	}
+	err = mkdag.VerifyPayload(m.Hasher, node.PayloadID, "Zm9yZ2Vk")
+	if !errors.As(err, &verifyErr) || verifyErr.ID != node.PayloadID {
+		t.Errorf("expected forged payload to fail, err: %v", err)
+	}
+	if err := mkdag.VerifyRoot(m.Hasher, m.RootMerkleID, sources[1:]); err == nil {
+		t.Errorf("expected missing source to fail")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := mkdag.NewHistory(2, 0)
+	a := &mkdag.MerkleDAG{RootMerkleID: "a"}
+	b := &mkdag.MerkleDAG{RootMerkleID: "b"}
+	c := &mkdag.MerkleDAG{RootMerkleID: "c"}
+
+	h.Push(a)
+	h.Push(b)
+	if h.Get("a") != a || h.Get("b") != b {
+		t.Fatalf("snapshots should be kept")
+	}
+
+	h.Push(c)
+	if h.Get("a") != nil {
+		t.Errorf("oldest snapshot should be dropped")
+	}
+	if h.Latest() != c {
+		t.Errorf("latest should be c")
+	}
+
+	h = mkdag.NewHistory(10, time.Millisecond)
+	h.Push(a)
+	h.Push(b)
+	time.Sleep(5 * time.Millisecond)
+	if h.Get("a") != nil {
+		t.Errorf("expired snapshot should not be returned")
+	}
+	if h.Get("b") != b {
+		t.Errorf("latest snapshot should never expire")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	mutations := []func(*dag.DAG){
+		func(d *dag.DAG) { d.AddRandomNodes(10) },
+		func(d *dag.DAG) { d.DeleteRandomNodes(10) },
+		func(d *dag.DAG) { d.UpdateRandomNodes(10) },
+	}
+
+	for i := 0; i < 9; i++ {
+		prev := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 500})
+		next := prev.Clone()
+		mutations[i%len(mutations)](next)
+
+		diff := mkdag.Diff(mkdag.GenerateMerkleDAG(prev, nil, nil), mkdag.GenerateMerkleDAG(next, nil, nil))
+
+		// Same as the diff of the whole DAGs, as nodes are addressed by their
+		// payload
+		added, removed, _ := mkdag.DiffDAG(prev, next)
+		assertSameIDs(t, "added", nodeIDs(added.Nodes), diff.Added)
+		assertSameIDs(t, "removed", nodeIDs(removed.Nodes), diff.Removed)
+		assertSameIDs(t, "added edges", edgeIDs(added.Edges), edgeIDs(diff.AddedEdges))
+		assertSameIDs(t, "removed edges", edgeIDs(removed.Edges), edgeIDs(diff.RemovedEdges))
+		if len(diff.Updated) == 0 {
+			t.Errorf("no updated ancestor")
+		}
+	}
+
+	m := mkdag.GenerateMerkleDAG(dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}), nil, nil)
+	if diff := mkdag.Diff(m, m); !diff.IsEmpty() {
+		t.Errorf("diff of the same MerkleDAG not empty: %v", diff)
+	}
+}
+
+func TestDelta(t *testing.T) {
+	mutations := []func(*dag.DAG){
+		func(d *dag.DAG) { d.AddRandomNodes(10) },
+		func(d *dag.DAG) { d.DeleteRandomNodes(10) },
+		func(d *dag.DAG) { d.UpdateRandomNodes(10) },
+	}
+
+	for i := 0; i < 9; i++ {
+		prevDAG := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 500})
+		nextDAG := prevDAG.Clone()
+		mutations[i%len(mutations)](nextDAG)
+
+		prev := mkdag.GenerateMerkleDAG(prevDAG, nil, nil)
+		next := mkdag.GenerateMerkleDAG(nextDAG, nil, nil)
+		nodes, payloads := mkdag.Delta(prev, next)
+		if nodes.Len() == 0 || nodes.Len() >= next.MerkleGraph.Len() {
+			t.Errorf("unexpected delta size: %d of %d", nodes.Len(), next.MerkleGraph.Len())
+		}
+
+		// prev and the delta hold every node and payload reachable in next
+		var stack []mkdag.Node
+		for _, source := range next.Sources {
+			stack = append(stack, mkdag.Node{MerkleID: source.MerkleID, PayloadID: source.PayloadID})
+		}
+		for len(stack) > 0 {
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			children, ok := nodes.Get(node.MerkleID)
+			if prev.MerkleGraph.Has(node.MerkleID) {
+				if ok {
+					t.Fatalf("node of prev in the delta, merkle_id: %s", node.MerkleID)
+				}
+				children = prev.Children(node.MerkleID)
+			} else if !ok {
+				t.Fatalf("node missing from the delta, merkle_id: %s", node.MerkleID)
+			}
+
+			if !payloads.Has(node.PayloadID) && !prev.PayloadMap.Has(node.PayloadID) {
+				t.Fatalf("payload missing from the delta, payload_id: %s", node.PayloadID)
+			}
+
+			for _, child := range children {
+				stack = append(stack, *child)
+			}
+		}
+	}
+}
+
+func nodeIDs(nodes []dag.Node) []string {
+	var r []string
+	for _, node := range nodes {
+		r = append(r, node.ID)
+	}
+	return r
+}
+
+func edgeIDs(edges []dag.Edge) []string {
+	var r []string
+	for _, edge := range edges {
+		r = append(r, edge.From+"->"+edge.To)
+	}
+	return r
+}
+
+func assertSameIDs(t *testing.T, name string, expected, actual []string) {
+	t.Helper()
+
+	sort.Strings(expected)
+	sort.Strings(actual)
+	if len(expected) != len(actual) {
+		t.Fatalf("%s not match, expected: %d, actual: %d", name, len(expected), len(actual))
+	}
+	for i := range expected {
+		if expected[i] != actual[i] {
+			t.Fatalf("%s not match, expected: %s, actual: %s", name, expected[i], actual[i])
+		}
+	}
+}
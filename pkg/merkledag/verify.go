@@ -0,0 +1,118 @@
+package merkledag
+
+import (
+	"dag-poll/pkg/dag"
+	"encoding/base64"
+	"fmt"
+)
+
+// VerifyError is returned when an ID does not match the content it is
+// supposed to be the hash of.
+type VerifyError struct {
+	// "root", "merkle node" or "payload"
+	Kind string
+	ID   string
+	// The ID computed from the content
+	Actual string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("%s verification failed, id: %s, actual: %s", e.Kind, e.ID, e.Actual)
+}
+
+// VerifyRoot checks the root is the hash of the MerkleIDs of the sources.
+func VerifyRoot(hasher Hasher, rootMerkleID MerkleID, sources []MerkleID) error {
+	actual := RootMerkleID(hasher, sources)
+	if actual != rootMerkleID {
+		return &VerifyError{Kind: "root", ID: rootMerkleID, Actual: actual}
+	}
+	return nil
+}
+
+// VerifyNode checks the MerkleID is the hash of the payloadID and the
+// MerkleIDs of the children.
+func VerifyNode(hasher Hasher, merkleID MerkleID, payloadID PayloadID, children []MerkleID) error {
+	actual := NodeMerkleID(hasher, payloadID, children)
+	if actual != merkleID {
+		return &VerifyError{Kind: "merkle node", ID: merkleID, Actual: actual}
+	}
+	return nil
+}
+
+// VerifyPayload checks the base64 encoded payload hashes to the payloadID.
+func VerifyPayload(hasher Hasher, payloadID PayloadID, payload Payload) error {
+	b, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return &VerifyError{Kind: "payload", ID: payloadID, Actual: "invalid base64"}
+	}
+
+	actual := HashPayload(hasher, b)
+	if actual != payloadID {
+		return &VerifyError{Kind: "payload", ID: payloadID, Actual: actual}
+	}
+	return nil
+}
+
+// VerifyDAG checks the ID of every node of d is the hash of its payload, as
+// observers verify the PayloadIDs with the hash function of the Merkle IDs.
+func VerifyDAG(hasher Hasher, d *dag.DAG) error {
+	return verifyNodes(hasher, d.Nodes)
+}
+
+// VerifyChanges is VerifyDAG for the nodes added or updated by the changes
+// given to ApplyChanges, the other nodes are the ones of a verified DAG.
+func VerifyChanges(hasher Hasher, added *dag.DAG, updated []Update) error {
+	if added != nil {
+		if err := verifyNodes(hasher, added.Nodes); err != nil {
+			return err
+		}
+	}
+	for _, u := range updated {
+		if err := VerifyPayload(hasher, u.To.ID, u.To.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyChangeSet is VerifyChanges for the nodes added or updated by a
+// ChangeSet.
+func VerifyChangeSet(hasher Hasher, cs dag.ChangeSet) error {
+	for _, c := range cs {
+		if c.Kind != dag.ChangeAddNode && c.Kind != dag.ChangeUpdatePayload {
+			continue
+		}
+		if err := c.Validate(); err != nil {
+			return err
+		}
+		if err := VerifyPayload(hasher, c.Node.ID, c.Node.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyNodes(hasher Hasher, nodes []dag.Node) error {
+	for _, node := range nodes {
+		if err := VerifyPayload(hasher, node.ID, node.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckID checks the ID is lowercase hex of the size of the hasher, like all
+// the IDs it makes, before an ID received from the network is used as e.g.
+// a file name.
+func CheckID(hasher Hasher, id string) error {
+	size := hasherOrDefault(hasher).New().Size() * 2
+	if len(id) != size {
+		return fmt.Errorf("invalid id: %.80q, expected %d hex characters", id, size)
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return fmt.Errorf("invalid id: %q, expected lowercase hex", id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The binary encoding is a sequence of uvarint prefixed fields. IDs are sent
+// as raw hash bytes and payloads as raw bytes instead of hex and base64,
+// which is about half the size of the JSON encoding.
+const (
+	ContentTypeJSON   = "application/json"
+	ContentTypeBinary = "application/vnd.dag-poll.v1"
+)
+
+// AcceptsBinary is true if the request asks for the binary encoding with a
+// non zero quality, not lower than the one of JSON, JSON stays the default.
+func AcceptsBinary(r *http.Request) bool {
+	binaryQ, jsonQ := 0.0, 0.0
+	for _, accept := range r.Header.Values("Accept") {
+		for _, v := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if s, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(s, 64); err != nil {
+					continue
+				}
+			}
+			switch mediaType {
+			case ContentTypeBinary:
+				binaryQ = max(binaryQ, q)
+			case ContentTypeJSON:
+				jsonQ = max(jsonQ, q)
+			}
+		}
+	}
+	return binaryQ > 0 && binaryQ >= jsonQ
+}
+
+// IsBinary is true if the response is in the binary encoding.
+func IsBinary(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == ContentTypeBinary
+}
+
+// Flags in the lowest bit of the length of a field
+const (
+	fieldString = 0
+	// Hex or base64 string sent as its decoded bytes
+	fieldRaw = 1
+)
+
+// Limits what a malformed length prefix can make the reader allocate
+const maxFieldSize = 64 << 20
+
+type binaryWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func newBinaryWriter(w io.Writer) *binaryWriter {
+	return &binaryWriter{w: bufio.NewWriter(w)}
+}
+
+func (b *binaryWriter) uvarint(v uint64) {
+	if b.err != nil {
+		return
+	}
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	_, b.err = b.w.Write(buf[:n])
+}
+
+func (b *binaryWriter) field(flag uint64, v []byte) {
+	b.uvarint(uint64(len(v))<<1 | flag)
+	if b.err != nil {
+		return
+	}
+	_, b.err = b.w.Write(v)
+}
+
+func (b *binaryWriter) string(s string) {
+	b.field(fieldString, []byte(s))
+}
+
+// id writes a lowercase hex ID as raw bytes, any other string as is.
+func (b *binaryWriter) id(s string) {
+	v, err := hex.DecodeString(s)
+	if err != nil || hex.EncodeToString(v) != s {
+		b.string(s)
+		return
+	}
+	b.field(fieldRaw, v)
+}
+
+// payload writes a base64 payload as raw bytes, any other string as is.
+func (b *binaryWriter) payload(s string) {
+	v, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || base64.StdEncoding.EncodeToString(v) != s {
+		b.string(s)
+		return
+	}
+	b.field(fieldRaw, v)
+}
+
+func (b *binaryWriter) flush() error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.w.Flush()
+}
+
+type binaryReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func newBinaryReader(r io.Reader) *binaryReader {
+	return &binaryReader{r: bufio.NewReader(r)}
+}
+
+func (b *binaryReader) uvarint() uint64 {
+	if b.err != nil {
+		return 0
+	}
+	var v uint64
+	v, b.err = binary.ReadUvarint(b.r)
+	return v
+}
+
+// count reads the length of a list, bounded so a malformed one fails instead
+// of allocating.
+func (b *binaryReader) count() int {
+	v := b.uvarint()
+	if b.err == nil && v > maxFieldSize {
+		b.err = fmt.Errorf("list too long: %d", v)
+	}
+	return int(v)
+}
+
+// Preallocate no more than this for a list, the length is not trusted
+func capacity(n int) int {
+	if n > 1024 {
+		return 1024
+	}
+	return n
+}
+
+func (b *binaryReader) field() (flag uint64, v []byte) {
+	n := b.uvarint()
+	if b.err != nil {
+		return 0, nil
+	}
+	if n>>1 > maxFieldSize {
+		b.err = fmt.Errorf("field too long: %d", n>>1)
+		return 0, nil
+	}
+
+	v = make([]byte, n>>1)
+	_, b.err = io.ReadFull(b.r, v)
+	if errors.Is(b.err, io.EOF) {
+		b.err = io.ErrUnexpectedEOF
+	}
+	return n & 1, v
+}
+
+func (b *binaryReader) string() string {
+	_, v := b.field()
+	return string(v)
+}
+
+func (b *binaryReader) id() string {
+	flag, v := b.field()
+	if flag == fieldRaw {
+		return hex.EncodeToString(v)
+	}
+	return string(v)
+}
+
+func (b *binaryReader) payload() string {
+	flag, v := b.field()
+	if flag == fieldRaw {
+		return base64.StdEncoding.EncodeToString(v)
+	}
+	return string(v)
+}
+
+func (s *SourcesResponse) PipeBinary(w io.Writer) error {
+	b := newBinaryWriter(w)
+	b.uvarint(uint64(s.Size))
+	b.uvarint(uint64(len(s.Sources)))
+	for _, source := range s.Sources {
+		b.string(source.Name)
+		b.id(source.ID)
+		b.id(source.PayloadID)
+	}
+	return b.flush()
+}
+
+func (s *SourcesResponse) LoadBinary(r io.Reader) error {
+	b := newBinaryReader(r)
+	s.Size = b.count()
+	n := b.count()
+	if b.err != nil {
+		return b.err
+	}
+
+	s.Sources = make([]Source, 0, capacity(n))
+	for i := 0; i < n && b.err == nil; i++ {
+		s.Sources = append(s.Sources, Source{
+			Name:      b.string(),
+			ID:        b.id(),
+			PayloadID: b.id(),
+		})
+	}
+	return b.err
+}
+
+func (q QueryResponse) PipeBinary(w io.Writer) error {
+	b := newBinaryWriter(w)
+	b.query(q)
+	return b.flush()
+}
+
+func (q *QueryResponse) LoadBinary(r io.Reader) error {
+	b := newBinaryReader(r)
+	*q = b.query()
+	return b.err
+}
+
+func (b *binaryWriter) query(q QueryResponse) {
+	b.uvarint(uint64(len(q)))
+	for merkleID, items := range q {
+		b.id(merkleID)
+		b.uvarint(uint64(len(items)))
+		for _, item := range items {
+			b.id(item.MerkleID)
+			b.id(item.PayloadID)
+		}
+	}
+}
+
+func (b *binaryReader) query() QueryResponse {
+	n := b.count()
+	if b.err != nil {
+		return nil
+	}
+
+	q := make(QueryResponse, capacity(n))
+	for i := 0; i < n && b.err == nil; i++ {
+		merkleID := b.id()
+		m := b.count()
+		if b.err != nil {
+			break
+		}
+
+		items := make([]QueryItem, 0, capacity(m))
+		for j := 0; j < m && b.err == nil; j++ {
+			items = append(items, QueryItem{
+				MerkleID:  b.id(),
+				PayloadID: b.id(),
+			})
+		}
+		q[merkleID] = items
+	}
+	return q
+}
+
+func (p PayloadResponse) PipeBinary(w io.Writer) error {
+	b := newBinaryWriter(w)
+	b.payload(p.Payload)
+	return b.flush()
+}
+
+func (p *PayloadResponse) LoadBinary(r io.Reader) error {
+	b := newBinaryReader(r)
+	p.Payload = b.payload()
+	return b.err
+}
+
+func (p *PayloadsResponse) PipeBinary(w io.Writer) error {
+	b := newBinaryWriter(w)
+	b.payloads(p.Payloads)
+	b.uvarint(uint64(len(p.Missing)))
+	for _, payloadID := range p.Missing {
+		b.id(payloadID)
+	}
+	return b.flush()
+}
+
+func (p *PayloadsResponse) LoadBinary(r io.Reader) error {
+	b := newBinaryReader(r)
+	p.Payloads = b.payloads()
+
+	m := b.count()
+	if b.err != nil {
+		return b.err
+	}
+	p.Missing = nil
+	for i := 0; i < m && b.err == nil; i++ {
+		p.Missing = append(p.Missing, b.id())
+	}
+	return b.err
+}
+
+func (b *binaryWriter) payloads(payloads map[string]string) {
+	b.uvarint(uint64(len(payloads)))
+	for payloadID, payload := range payloads {
+		b.id(payloadID)
+		b.payload(payload)
+	}
+}
+
+func (b *binaryReader) payloads() map[string]string {
+	n := b.count()
+	if b.err != nil {
+		return nil
+	}
+
+	payloads := make(map[string]string, capacity(n))
+	for i := 0; i < n && b.err == nil; i++ {
+		payloadID := b.id()
+		payloads[payloadID] = b.payload()
+	}
+	return payloads
+}
+
+func (d *DeltaResponse) PipeBinary(w io.Writer) error {
+	b := newBinaryWriter(w)
+	b.id(d.From)
+	b.id(d.To)
+	b.query(d.Nodes)
+	b.payloads(d.Payloads)
+	return b.flush()
+}
+
+func (d *DeltaResponse) LoadBinary(r io.Reader) error {
+	b := newBinaryReader(r)
+	d.From = b.id()
+	d.To = b.id()
+	d.Nodes = b.query()
+	d.Payloads = b.payloads()
+	return b.err
+}
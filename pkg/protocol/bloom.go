@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// Bounds of a BloomFilter, a larger set gets a higher false positive rate
+// rather than a larger filter
+const (
+	MaxBloomFilterSize = 1 << 20
+	maxBloomHashes     = 16
+)
+
+// BloomFilter is a compact set of IDs, sent by an observer for the MerkleIDs
+// it already has so the observable leaves their subtrees out of a query.
+// It has no false negatives, but may contain IDs never added: the observable
+// then leaves out a subtree the observer does not have, which the observer
+// queries on its own once it walks down to it.
+type BloomFilter struct {
+	Bits []byte `json:"bits"`
+	// Number of hash functions
+	K int `json:"k"`
+}
+
+// NewBloomFilter returns an empty filter sized for n IDs with the false
+// positive rate, e.g. 0.01.
+func NewBloomFilter(n int, falsePositiveRate float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+
+	bits := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	size := int(math.Ceil(bits / 8))
+	size = min(max(size, 8), MaxBloomFilterSize)
+
+	k := int(math.Round(float64(size*8) / float64(n) * math.Ln2))
+	k = min(max(k, 1), maxBloomHashes)
+
+	return &BloomFilter{Bits: make([]byte, size), K: k}
+}
+
+// Validate checks a filter received from the network before it is used.
+func (f *BloomFilter) Validate() error {
+	if len(f.Bits) == 0 || len(f.Bits) > MaxBloomFilterSize {
+		return fmt.Errorf("invalid bloom filter size: %d", len(f.Bits))
+	}
+	if f.K < 1 || f.K > maxBloomHashes {
+		return fmt.Errorf("invalid bloom filter hash count: %d", f.K)
+	}
+	return nil
+}
+
+// Positions of the bits of an ID, by double hashing a single FNV-1a hash
+func (f *BloomFilter) positions(id string, fn func(i uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32|1
+
+	m := uint64(len(f.Bits)) * 8
+	for i := 0; i < f.K; i++ {
+		fn((h1 + uint64(i)*h2) % m)
+	}
+}
+
+func (f *BloomFilter) Add(id string) {
+	f.positions(id, func(i uint64) {
+		f.Bits[i/8] |= 1 << (i % 8)
+	})
+}
+
+// Contains is true if the ID was added, or on a false positive.
+func (f *BloomFilter) Contains(id string) bool {
+	ok := true
+	f.positions(id, func(i uint64) {
+		if f.Bits[i/8]&(1<<(i%8)) == 0 {
+			ok = false
+		}
+	})
+	return ok
+}
@@ -3,6 +3,9 @@ package protocol_test
 import (
 	"bytes"
 	"dag-poll/pkg/protocol"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -39,3 +42,167 @@ func TestRootPipe(t *testing.T) {
 		t.Errorf("Expected %s, but got %s", expected, result)
 	}
 }
+
+func TestQueryBinary(t *testing.T) {
+	q := protocol.QueryResponse{
+		"5d41402abc4b2a76b9719d911017c592": {
+			{MerkleID: "7d793037a0760186574b0282f2f435e7", PayloadID: "b10a8db164e0754105b7a99be72e3fe5"},
+			// Not hex, sent as is
+			{MerkleID: "hello world", PayloadID: "ABCD"},
+		},
+		"e59ff97941044f85df5297e1c302d260": {},
+	}
+
+	var buf, jsonBuf bytes.Buffer
+	if err := q.PipeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Pipe(&jsonBuf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= jsonBuf.Len() {
+		t.Errorf("binary is not smaller, binary: %d, json: %d", buf.Len(), jsonBuf.Len())
+	}
+
+	var v protocol.QueryResponse
+	if err := v.LoadBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(q, v) {
+		t.Errorf("Expected %v, but got %v", q, v)
+	}
+}
+
+func TestPayloadsBinary(t *testing.T) {
+	p := &protocol.PayloadsResponse{
+		Payloads: map[string]string{
+			"5d41402abc4b2a76b9719d911017c592": "aGVsbG8=",
+			// Not base64, sent as is
+			"7d793037a0760186574b0282f2f435e7": "hello",
+		},
+		Missing: []string{"b10a8db164e0754105b7a99be72e3fe5"},
+	}
+
+	var buf bytes.Buffer
+	if err := p.PipeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var v protocol.PayloadsResponse
+	if err := v.LoadBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, &v) {
+		t.Errorf("Expected %v, but got %v", p, v)
+	}
+}
+
+func TestSourcesBinary(t *testing.T) {
+	s := &protocol.SourcesResponse{
+		Size: 2,
+		Sources: []protocol.Source{
+			{Name: "Source-1", ID: "5d41402abc4b2a76b9719d911017c592", PayloadID: "7d793037a0760186574b0282f2f435e7"},
+			{Name: "Source-2", ID: "e59ff97941044f85df5297e1c302d260", PayloadID: "b10a8db164e0754105b7a99be72e3fe5"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := s.PipeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncated
+	var v protocol.SourcesResponse
+	if err := v.LoadBinary(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Errorf("expected truncated sources to fail")
+	}
+
+	if err := v.LoadBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, &v) {
+		t.Errorf("Expected %v, but got %v", s, v)
+	}
+}
+
+func TestDeltaBinary(t *testing.T) {
+	d := &protocol.DeltaResponse{
+		From: "5d41402abc4b2a76b9719d911017c592",
+		To:   "7d793037a0760186574b0282f2f435e7",
+		Nodes: protocol.QueryResponse{
+			"e59ff97941044f85df5297e1c302d260": {
+				{MerkleID: "b10a8db164e0754105b7a99be72e3fe5", PayloadID: "5d41402abc4b2a76b9719d911017c592"},
+			},
+			"b10a8db164e0754105b7a99be72e3fe5": {},
+		},
+		Payloads: map[string]string{
+			"5d41402abc4b2a76b9719d911017c592": "aGVsbG8=",
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := d.PipeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var v protocol.DeltaResponse
+	if err := v.LoadBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, &v) {
+		t.Errorf("Expected %v, but got %v", d, v)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	const n = 10000
+	f := protocol.NewBloomFilter(n, 0.01)
+	for i := 0; i < n; i++ {
+		f.Add(fmt.Sprintf("added-%d", i))
+	}
+	for i := 0; i < n; i++ {
+		if !f.Contains(fmt.Sprintf("added-%d", i)) {
+			t.Fatalf("false negative, id: added-%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if f.Contains(fmt.Sprintf("other-%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / n; rate > 0.02 {
+		t.Errorf("false positive rate too high: %f", rate)
+	}
+
+	// Capped in size, at the cost of more false positives
+	if f := protocol.NewBloomFilter(1<<30, 0.01); len(f.Bits) != protocol.MaxBloomFilterSize {
+		t.Errorf("filter not capped, size: %d", len(f.Bits))
+	}
+
+	if err := (&protocol.BloomFilter{Bits: make([]byte, 8), K: 100}).Validate(); err == nil {
+		t.Errorf("expected too many hash functions to fail")
+	}
+}
+
+func TestAcceptsBinary(t *testing.T) {
+	r := httptest.NewRequest("GET", "/query", nil)
+	if protocol.AcceptsBinary(r) {
+		t.Errorf("JSON must be the default")
+	}
+
+	for accept, expected := range map[string]bool{
+		"application/json;q=0.9, " + protocol.ContentTypeBinary: true,
+		protocol.ContentTypeBinary + ";q=0.5":                   true,
+		protocol.ContentTypeBinary + ";q=0":                     false,
+		protocol.ContentTypeBinary + ";q=0.0, application/json": false,
+		protocol.ContentTypeBinary + ";q=0.5, application/json": false,
+		protocol.ContentTypeBinary + ";q=x":                     false,
+	} {
+		r.Header.Set("Accept", accept)
+		if protocol.AcceptsBinary(r) != expected {
+			t.Errorf("expected binary accepted: %v, accept: %s", expected, accept)
+		}
+	}
+}
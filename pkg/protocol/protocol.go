@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,8 +9,13 @@ import (
 )
 
 type RootResponse struct {
-	ID      string `json:"id"`
-	Version int64  `json:"version"`
+	ID string `json:"id"`
+	// Sequence number of the MerkleDAG, increasing with every new root
+	Version int64 `json:"version"`
+	// Unix time the Version was assigned at
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// Hash function of the Merkle and payload IDs, empty is md5
+	Hash string `json:"hash,omitempty"`
 }
 
 func (root *RootResponse) Pipe(w io.Writer) error {
@@ -20,6 +26,9 @@ func (root *RootResponse) Load(r io.Reader) error {
 	return json.NewDecoder(r).Decode(&root)
 }
 
+// Header set to the Version of the MerkleDAG a response is taken from
+const VersionHeader = "Dag-Version"
+
 type SourceRequest struct {
 	ID string `json:"id"`
 }
@@ -37,7 +46,7 @@ func (s *SourcesResponse) Load(r io.Reader) error {
 	return json.NewDecoder(r).Decode(s)
 }
 
-func (s *SourcesResponse) Pipe(w http.ResponseWriter) error {
+func (s *SourcesResponse) Pipe(w io.Writer) error {
 	return json.NewEncoder(w).Encode(s)
 }
 
@@ -58,6 +67,58 @@ func (q *QueryRequest) Load(r *http.Request) error {
 	return json.NewDecoder(r.Body).Decode(q)
 }
 
+// QueryTreeRequest is the object form of the /query body, for a query with a
+// depth: the MerkleIDs to query, and the MerkleIDs the observer already has,
+// listed or in a BloomFilter, whose subtrees are left out of the response.
+// A filter registered with POST /have is sent as its token instead.
+type QueryTreeRequest struct {
+	IDs        []string     `json:"ids"`
+	Have       []string     `json:"have,omitempty"`
+	HaveFilter *BloomFilter `json:"have_filter,omitempty"`
+	HaveToken  string       `json:"have_token,omitempty"`
+}
+
+// Load reads the object form, or the array of MerkleIDs of a QueryRequest.
+func (q *QueryTreeRequest) Load(r *http.Request) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return err
+	}
+
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		q.Have = nil
+		q.HaveFilter = nil
+		return json.Unmarshal(raw, &q.IDs)
+	}
+	return json.Unmarshal(raw, q)
+}
+
+// HaveRequest is the body of POST /have, registering the MerkleIDs an
+// observer has once for all the queries of a sync.
+type HaveRequest struct {
+	Have       []string     `json:"have,omitempty"`
+	HaveFilter *BloomFilter `json:"have_filter,omitempty"`
+}
+
+func (h *HaveRequest) Load(r io.Reader) error {
+	return json.NewDecoder(r).Decode(h)
+}
+
+// HaveResponse is the token of the registered MerkleIDs, valid for TTL
+// seconds after its last use. An unknown token is answered with 410.
+type HaveResponse struct {
+	Token string `json:"token"`
+	TTL   int64  `json:"ttl"`
+}
+
+func (h *HaveResponse) Pipe(w io.Writer) error {
+	return json.NewEncoder(w).Encode(h)
+}
+
+func (h *HaveResponse) Load(r io.Reader) error {
+	return json.NewDecoder(r).Decode(h)
+}
+
 type QueryResponse map[string][]QueryItem
 
 func (q QueryResponse) Pipe(w io.Writer) error {
@@ -101,6 +162,86 @@ func (p *PayloadResponse) Load(r io.Reader) error {
 	return json.NewDecoder(r).Decode(p)
 }
 
+type PayloadsRequest []string
+
+func (p *PayloadsRequest) Load(r io.Reader) error {
+	return json.NewDecoder(r).Decode(p)
+}
+
+// PayloadsResponse holds the found payloads by PayloadID, and the requested
+// PayloadIDs the observable does not have.
+type PayloadsResponse struct {
+	Payloads map[string]string `json:"payloads"`
+	Missing  []string          `json:"missing"`
+}
+
+func (p *PayloadsResponse) Pipe(w io.Writer) error {
+	return json.NewEncoder(w).Encode(p)
+}
+
+func (p *PayloadsResponse) Load(r io.Reader) error {
+	return json.NewDecoder(r).Decode(p)
+}
+
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DiffResponse is what changed from one root to another, by the IDs of the
+// DAG nodes.
+type DiffResponse struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// In both, with their edges or any of their descendants changed
+	Updated        []string `json:"updated"`
+	AddedEdges     []Edge   `json:"added_edges"`
+	RemovedEdges   []Edge   `json:"removed_edges"`
+	AddedSources   []Source `json:"added_sources"`
+	RemovedSources []Source `json:"removed_sources"`
+}
+
+func (d *DiffResponse) Pipe(w io.Writer) error {
+	return json.NewEncoder(w).Encode(d)
+}
+
+func (d *DiffResponse) Load(r io.Reader) error {
+	return json.NewDecoder(r).Decode(d)
+}
+
+// DeltaResponse holds the Merkle nodes of To not in From, by MerkleID as in
+// QueryResponse, and the payloads of To not in From, by PayloadID.
+type DeltaResponse struct {
+	From     string            `json:"from"`
+	To       string            `json:"to"`
+	Nodes    QueryResponse     `json:"nodes"`
+	Payloads map[string]string `json:"payloads"`
+}
+
+func (d *DeltaResponse) Pipe(w io.Writer) error {
+	return json.NewEncoder(w).Encode(d)
+}
+
+func (d *DeltaResponse) Load(r io.Reader) error {
+	return json.NewDecoder(r).Decode(d)
+}
+
+// NamespacesResponse lists the namespaces of an observable serving several
+// DAGs, each one under /ns/{name}/.
+type NamespacesResponse struct {
+	Namespaces []string `json:"namespaces"`
+}
+
+func (n *NamespacesResponse) Pipe(w io.Writer) error {
+	return json.NewEncoder(w).Encode(n)
+}
+
+func (n *NamespacesResponse) Load(r io.Reader) error {
+	return json.NewDecoder(r).Decode(n)
+}
+
 type ErrorMessage struct {
 	Message string `json:"message"`
 }
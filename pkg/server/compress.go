@@ -0,0 +1,185 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Responses smaller than this are not worth the CPU of compressing them
+const defaultCompressMinSize = 1024
+
+var (
+	gzipWriters = sync.Pool{New: func() any {
+		return gzip.NewWriter(nil)
+	}}
+	zstdWriters = sync.Pool{New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return w
+	}}
+)
+
+// acceptEncoding picks the compression of the response from the
+// Accept-Encoding header of the request, zstd first, empty if none.
+func acceptEncoding(r *http.Request) string {
+	accepted := make(map[string]bool)
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, v := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(v), ";")
+			q, ok := qValue(params)
+			if !ok {
+				continue
+			}
+			accepted[strings.ToLower(strings.TrimSpace(name))] = q > 0
+		}
+	}
+
+	for _, encoding := range []string{"zstd", "gzip"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// qValue returns the q parameter of the params of a coding, 1 if it has none,
+// ok is false if it is not a number.
+func qValue(params string) (q float64, ok bool) {
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(key), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return q, err == nil
+	}
+	return 1, true
+}
+
+// compress encodes the responses of next as asked for by Accept-Encoding,
+// once they turn out to be at least minSize.
+func compress(next http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addVary(w.Header(), "Accept-Encoding")
+
+		encoding := acceptEncoding(r)
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			minSize:        minSize,
+			status:         http.StatusOK,
+		}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter buffers the response until it reaches minSize, then starts
+// compressing it. Smaller responses are sent as is on Close, unless flushed
+// before.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status int
+	buf    []byte
+	// Set once compressing
+	w encoder
+}
+
+// encoder is implemented by both gzip.Writer and zstd.Encoder.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	c.status = status
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.w != nil {
+		return c.w.Write(p)
+	}
+
+	c.buf = append(c.buf, p...)
+	if len(c.buf) < c.minSize {
+		return len(p), nil
+	}
+
+	if err := c.start(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// start sends the header and compresses the buffered response.
+func (c *compressWriter) start() error {
+	h := c.ResponseWriter.Header()
+	h.Set("Content-Encoding", c.encoding)
+	h.Del("Content-Length")
+	c.ResponseWriter.WriteHeader(c.status)
+
+	switch c.encoding {
+	case "zstd":
+		zw := zstdWriters.Get().(*zstd.Encoder)
+		zw.Reset(c.ResponseWriter)
+		c.w = &pooledWriter{encoder: zw, pool: &zstdWriters}
+	default:
+		gw := gzipWriters.Get().(*gzip.Writer)
+		gw.Reset(c.ResponseWriter)
+		c.w = &pooledWriter{encoder: gw, pool: &gzipWriters}
+	}
+
+	buf := c.buf
+	c.buf = nil
+	_, err := c.w.Write(buf)
+	return err
+}
+
+// Flush sends what was written so far, compressed even if it is smaller than
+// minSize, as the handler wants it out now.
+func (c *compressWriter) Flush() {
+	if c.w == nil {
+		if err := c.start(); err != nil {
+			return
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *compressWriter) Close() error {
+	if c.w != nil {
+		return c.w.Close()
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+	_, err := c.ResponseWriter.Write(c.buf)
+	return err
+}
+
+// pooledWriter puts the compressor back to its pool on Close.
+type pooledWriter struct {
+	encoder
+	pool *sync.Pool
+}
+
+func (p *pooledWriter) Close() error {
+	err := p.encoder.Close()
+	p.pool.Put(p.encoder)
+	return err
+}
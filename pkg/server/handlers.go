@@ -0,0 +1,548 @@
+package server
+
+import (
+	mkdag "dag-poll/pkg/merkledag"
+	"dag-poll/pkg/protocol"
+	"dag-poll/pkg/utils"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *Server) root(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	head := s.state.Head()
+	if head == nil {
+		http.Error(w, protocol.Error(`Root not found`), http.StatusNotFound)
+		return
+	}
+
+	resp := rootResponse(head)
+	err := resp.Pipe(w)
+	if err != nil {
+		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
+		return
+	}
+}
+
+func rootResponse(m *mkdag.MerkleDAG) protocol.RootResponse {
+	return protocol.RootResponse{
+		ID:        m.RootMerkleID,
+		Version:   m.Version,
+		Timestamp: m.Timestamp,
+		Hash:      m.GetHasher().Name(),
+	}
+}
+
+// Long-poll, responds as soon as the root is different from the `since`
+// query parameter, or with the current root after the watch timeout.
+func (s *Server) rootWatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	since := r.URL.Query().Get("since")
+	select {
+	case <-s.state.Watch(since):
+	case <-time.After(s.watchTimeout):
+	case <-r.Context().Done():
+		return
+	}
+
+	head := s.state.Head()
+	if head == nil {
+		// Not 404, which tells observers the endpoint is not supported
+		http.Error(w, protocol.Error(`Root not found`), http.StatusServiceUnavailable)
+		return
+	}
+
+	resp := rootResponse(head)
+	err := resp.Pipe(w)
+	if err != nil {
+		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) sources(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	s.writeSources(w, r, r.PathValue("root"))
+}
+
+// The GET with a JSON body form of /sources/{root}, kept for older observers.
+func (s *Server) legacySources(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var sourceReq protocol.SourceRequest
+	r.Body = limitBody(w, r.Body)
+	err := sourceReq.Load(r)
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+
+	s.writeSources(w, r, sourceReq.ID)
+}
+
+func (s *Server) writeSources(w http.ResponseWriter, r *http.Request, rootMerkleID string) {
+	sources, ok := s.state.Sources(rootMerkleID)
+	if !ok {
+		msg := fmt.Sprintf("Root not match, current root: %v", s.state.Root())
+		http.Error(w, protocol.Error(msg), http.StatusNotFound)
+		return
+	}
+	if sources == nil {
+		http.Error(w, protocol.Error("Sources not found"), http.StatusNotFound)
+		return
+	}
+
+	v := make([]protocol.Source, len(sources))
+	for index, source := range sources {
+		v[index] = protocol.Source{
+			Name:      source.Name,
+			ID:        source.MerkleID,
+			PayloadID: source.PayloadID,
+		}
+	}
+
+	resp := &protocol.SourcesResponse{
+		Size:    len(sources),
+		Sources: v,
+	}
+
+	s.setVersion(w, rootMerkleID)
+	if err := pipe(w, r, resp); err != nil {
+		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) query(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var queryReq protocol.QueryTreeRequest
+	r.Body = limitBody(w, r.Body)
+	err := queryReq.Load(r)
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+
+	depth := 1
+	if v := r.URL.Query().Get("depth"); v != "" {
+		depth, err = strconv.Atoi(v)
+		if err != nil || depth < 1 {
+			http.Error(w, protocol.Error("Invalid depth"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if queryReq.HaveFilter != nil {
+		if err := queryReq.HaveFilter.Validate(); err != nil {
+			http.Error(w, protocol.Error(err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var registered func(mkdag.MerkleID) bool
+	if queryReq.HaveToken != "" {
+		registered = s.haves.get(queryReq.HaveToken)
+		if registered == nil {
+			// Expired, the observer registers its MerkleIDs again
+			http.Error(w, protocol.Error("Have token not found"), http.StatusGone)
+			return
+		}
+	}
+
+	var have func(mkdag.MerkleID) bool
+	if len(queryReq.Have) > 0 || queryReq.HaveFilter != nil || registered != nil {
+		haveSet := make(utils.Set[mkdag.MerkleID], len(queryReq.Have))
+		for _, merkleID := range queryReq.Have {
+			haveSet.Add(merkleID)
+		}
+		have = func(merkleID mkdag.MerkleID) bool {
+			if haveSet.Contains(merkleID) {
+				return true
+			}
+			if registered != nil && registered(merkleID) {
+				return true
+			}
+			return queryReq.HaveFilter != nil && queryReq.HaveFilter.Contains(merkleID)
+		}
+	}
+
+	v, ok := s.state.Query(r.URL.Query().Get("root"), queryReq.IDs, depth, have)
+	if !ok {
+		http.Error(w, protocol.Error("Root not found"), http.StatusNotFound)
+		return
+	}
+
+	m := make(protocol.QueryResponse, len(v))
+	for merkleID, items := range v {
+		m[merkleID] = make([]protocol.QueryItem, len(items))
+		for index, item := range items {
+			m[merkleID][index] = protocol.QueryItem{
+				MerkleID:  item.MerkleID,
+				PayloadID: item.PayloadID,
+			}
+		}
+	}
+
+	s.setVersion(w, r.URL.Query().Get("root"))
+	err = pipe(w, r, m)
+	if err != nil {
+		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Registers the MerkleIDs an observer has, listed or in a BloomFilter, for the
+// queries sending the returned token, so they are not sent with each one.
+func (s *Server) have(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var haveReq protocol.HaveRequest
+	if err := haveReq.Load(limitBody(w, r.Body)); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if haveReq.HaveFilter != nil {
+		if err := haveReq.HaveFilter.Validate(); err != nil {
+			http.Error(w, protocol.Error(err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, ok := s.haves.add(haveReq)
+	if !ok {
+		http.Error(w, protocol.Error("Too many MerkleIDs"), http.StatusBadRequest)
+		return
+	}
+
+	resp := protocol.HaveResponse{
+		Token: token,
+		TTL:   int64(haveTTL / time.Second),
+	}
+	if err := resp.Pipe(w); err != nil {
+		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// The children of a single Merkle node, which never change for its MerkleID,
+// so unlike POST /query it is cached by any HTTP cache in between.
+func (s *Server) node(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	merkleID := r.PathValue("id")
+	items, ok := s.state.Node(r.URL.Query().Get("root"), merkleID)
+	if !ok {
+		http.Error(w, protocol.Error("Root not found"), http.StatusNotFound)
+		return
+	}
+	if items == nil {
+		http.Error(w, protocol.Error("Node not found"), http.StatusNotFound)
+		return
+	}
+
+	if notModified(w, r, merkleID) {
+		return
+	}
+
+	v := make([]protocol.QueryItem, len(items))
+	for index, item := range items {
+		v[index] = protocol.QueryItem{
+			MerkleID:  item.MerkleID,
+			PayloadID: item.PayloadID,
+		}
+	}
+
+	if err := pipe(w, r, protocol.QueryResponse{merkleID: v}); err != nil {
+		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) payload(w http.ResponseWriter, r *http.Request) {
+	s.writePayload(w, r, r.PathValue("id"), true)
+}
+
+// The GET with a JSON body form of /payload/{id}, kept for older observers.
+func (s *Server) legacyPayload(w http.ResponseWriter, r *http.Request) {
+	var payloadRequest protocol.PayloadRequest
+	err := payloadRequest.Load(limitBody(w, r.Body))
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+
+	// Not cacheable, the URL is the same for every payload
+	s.writePayload(w, r, payloadRequest.PayloadID, false)
+}
+
+func (s *Server) writePayload(w http.ResponseWriter, r *http.Request, payloadID string, cacheable bool) {
+	payload, ok := s.state.Payload(r.URL.Query().Get("root"), payloadID)
+	if !ok {
+		http.Error(w, protocol.Error("Root not found"), http.StatusNotFound)
+		return
+	}
+	if payload == nil {
+		http.Error(w, protocol.Error("Payload not found"), http.StatusNotFound)
+		return
+	}
+
+	// The same payload is in many MerkleDAGs, a cached response does not tell
+	// which one it was taken from
+	if cacheable && notModified(w, r, payloadID) {
+		return
+	}
+	if !cacheable {
+		s.setVersion(w, r.URL.Query().Get("root"))
+	}
+
+	var payloadResponse protocol.PayloadResponse
+	payloadResponse.Payload = *payload
+
+	if err := pipe(w, r, payloadResponse); err != nil {
+		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) payloads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var payloadsRequest protocol.PayloadsRequest
+	err := payloadsRequest.Load(limitBody(w, r.Body))
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+
+	found, missing, ok := s.state.Payloads(r.URL.Query().Get("root"), payloadsRequest)
+	if !ok {
+		http.Error(w, protocol.Error("Root not found"), http.StatusNotFound)
+		return
+	}
+
+	resp := &protocol.PayloadsResponse{
+		Payloads: found,
+		Missing:  missing,
+	}
+
+	s.setVersion(w, r.URL.Query().Get("root"))
+	err = pipe(w, r, resp)
+	if err != nil {
+		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Max size of a request body, room for a BloomFilter of
+// protocol.MaxBloomFilterSize bytes in JSON along with the IDs of a query
+const maxBodySize = 8 << 20
+
+// limitBody caps the body read by a handler to maxBodySize, the request is
+// then answered with 413 by bodyError.
+func limitBody(w http.ResponseWriter, body io.ReadCloser) io.ReadCloser {
+	return http.MaxBytesReader(w, body, maxBodySize)
+}
+
+// bodyError answers a request whose body could not be loaded.
+func bodyError(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		http.Error(w, protocol.Error("Request body too large"), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, protocol.Error("Invalid http.Body"), http.StatusBadRequest)
+}
+
+// setVersion tells the Version of the MerkleDAG with the root the response is
+// taken from.
+func (s *Server) setVersion(w http.ResponseWriter, root string) {
+	if version, ok := s.state.Version(root); ok {
+		w.Header().Set(protocol.VersionHeader, strconv.FormatInt(version, 10))
+	}
+}
+
+// notModified marks the response to a content addressed resource as
+// cacheable forever, with its ID as ETag. It answers 304 and returns true if
+// the request already has it. The tag tells the JSON and binary encodings
+// apart, and is weak as the bytes also depend on the content encoding.
+func notModified(w http.ResponseWriter, r *http.Request, id string) bool {
+	tag := `"` + id + `"`
+	if protocol.AcceptsBinary(r) {
+		tag = `"` + id + `-bin"`
+	}
+	addVary(w.Header(), "Accept", "Accept-Encoding")
+	w.Header().Set("ETag", "W/"+tag)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	for _, header := range r.Header.Values("If-None-Match") {
+		for _, v := range strings.Split(header, ",") {
+			v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+			if v == tag || v == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// What changed from the root in the `from` query parameter to the one in
+// `to`, the current one if empty.
+func (s *Server) diff(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" {
+		http.Error(w, protocol.Error("Missing from"), http.StatusBadRequest)
+		return
+	}
+	if to == "" {
+		to = s.state.Root()
+	}
+
+	diff, ok, err := s.state.Diff(from, to)
+	if !ok {
+		http.Error(w, protocol.Error("Root not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, protocol.Error(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	resp := NewDiffResponse(from, to, diff)
+	if err := resp.Pipe(w); err != nil {
+		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// NewDiffResponse is the wire form of the diff from the root from to the root
+// to.
+func NewDiffResponse(from, to string, diff *mkdag.MerkleDiff) *protocol.DiffResponse {
+	resp := &protocol.DiffResponse{
+		From:    from,
+		To:      to,
+		Added:   diff.Added,
+		Removed: diff.Removed,
+		Updated: diff.Updated,
+	}
+	for _, edge := range diff.AddedEdges {
+		resp.AddedEdges = append(resp.AddedEdges, protocol.Edge{From: edge.From, To: edge.To})
+	}
+	for _, edge := range diff.RemovedEdges {
+		resp.RemovedEdges = append(resp.RemovedEdges, protocol.Edge{From: edge.From, To: edge.To})
+	}
+	for _, source := range diff.AddedSources {
+		resp.AddedSources = append(resp.AddedSources, protocol.Source{
+			Name:      source.Name,
+			ID:        source.MerkleID,
+			PayloadID: source.PayloadID,
+		})
+	}
+	for _, source := range diff.RemovedSources {
+		resp.RemovedSources = append(resp.RemovedSources, protocol.Source{
+			Name:      source.Name,
+			ID:        source.MerkleID,
+			PayloadID: source.PayloadID,
+		})
+	}
+	return resp
+}
+
+// Everything an observer holding the root in the `from` query parameter
+// needs to build the one in `to`, the current one if empty: the Merkle nodes
+// and the payloads it does not have, in one response instead of a walk.
+func (s *Server) delta(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" {
+		http.Error(w, protocol.Error("Missing from"), http.StatusBadRequest)
+		return
+	}
+	if to == "" {
+		to = s.state.Root()
+	}
+
+	nodes, payloads, ok, err := s.state.Delta(from, to)
+	if !ok {
+		http.Error(w, protocol.Error("Root not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, protocol.Error(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	resp := &protocol.DeltaResponse{
+		From:     from,
+		To:       to,
+		Nodes:    make(protocol.QueryResponse, nodes.Len()),
+		Payloads: make(map[string]string, payloads.Len()),
+	}
+	nodes.Range(func(merkleID mkdag.MerkleID, children []*mkdag.Node) bool {
+		items := make([]protocol.QueryItem, len(children))
+		for index, child := range children {
+			items[index] = protocol.QueryItem{
+				MerkleID:  child.MerkleID,
+				PayloadID: child.PayloadID,
+			}
+		}
+		resp.Nodes[merkleID] = items
+		return true
+	})
+	payloads.Range(func(payloadID mkdag.PayloadID, payload mkdag.Payload) bool {
+		resp.Payloads[payloadID] = payload
+		return true
+	})
+
+	s.setVersion(w, to)
+	if err := pipe(w, r, resp); err != nil {
+		http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
+		return
+	}
+}
+
+type piper interface {
+	Pipe(io.Writer) error
+	PipeBinary(io.Writer) error
+}
+
+// pipe writes v in the encoding asked for by the Accept header of r, JSON if
+// none is.
+func pipe(w http.ResponseWriter, r *http.Request, v piper) error {
+	addVary(w.Header(), "Accept")
+	if protocol.AcceptsBinary(r) {
+		w.Header().Set("Content-Type", protocol.ContentTypeBinary)
+		return v.PipeBinary(w)
+	}
+
+	w.Header().Set("Content-Type", protocol.ContentTypeJSON)
+	return v.Pipe(w)
+}
+
+// addVary adds the fields to the Vary header, unless already there.
+func addVary(h http.Header, fields ...string) {
+	for _, field := range fields {
+		found := false
+		for _, header := range h.Values("Vary") {
+			for _, v := range strings.Split(header, ",") {
+				if strings.EqualFold(strings.TrimSpace(v), field) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			h.Add("Vary", field)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/rand"
+	mkdag "dag-poll/pkg/merkledag"
+	"dag-poll/pkg/protocol"
+	"dag-poll/pkg/utils"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Registered MerkleIDs are dropped this long after their last query
+const haveTTL = 10 * time.Minute
+
+// Bytes of filters and listed MerkleIDs kept for all the tokens, the least
+// recently used ones are dropped beyond it
+const maxHaveBytes = 64 << 20
+
+// haves keeps the MerkleIDs registered by observers with POST /have, so a
+// BloomFilter is sent once per sync rather than with every query.
+type haves struct {
+	mu      sync.Mutex
+	entries map[string]*haveEntry
+	size    int
+}
+
+type haveEntry struct {
+	set    utils.Set[mkdag.MerkleID]
+	filter *protocol.BloomFilter
+	size   int
+	used   time.Time
+}
+
+func (e *haveEntry) contains(merkleID mkdag.MerkleID) bool {
+	return e.set.Contains(merkleID) || e.filter != nil && e.filter.Contains(merkleID)
+}
+
+// add registers the MerkleIDs, returns their token, false if they are too
+// many to keep.
+func (h *haves) add(req protocol.HaveRequest) (string, bool) {
+	e := &haveEntry{
+		set:    make(utils.Set[mkdag.MerkleID], len(req.Have)),
+		filter: req.HaveFilter,
+		used:   time.Now(),
+	}
+	for _, merkleID := range req.Have {
+		e.set.Add(merkleID)
+		e.size += len(merkleID)
+	}
+	if req.HaveFilter != nil {
+		e.size += len(req.HaveFilter.Bits)
+	}
+	if e.size > maxHaveBytes {
+		return "", false
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.entries == nil {
+		h.entries = make(map[string]*haveEntry)
+	}
+	h.sweep(e.size)
+	h.entries[token] = e
+	h.size += e.size
+	return token, true
+}
+
+// get returns the MerkleIDs of the token, nil if unknown or expired.
+func (h *haves) get(token string) func(mkdag.MerkleID) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e, ok := h.entries[token]
+	if !ok || time.Since(e.used) > haveTTL {
+		return nil
+	}
+	e.used = time.Now()
+	return e.contains
+}
+
+// sweep drops the expired entries, then the least recently used ones until
+// size more bytes fit. Must be called with h.mu held.
+func (h *haves) sweep(size int) {
+	for token, e := range h.entries {
+		if time.Since(e.used) > haveTTL {
+			h.drop(token)
+		}
+	}
+
+	for h.size+size > maxHaveBytes && len(h.entries) > 0 {
+		var oldest string
+		for token, e := range h.entries {
+			if oldest == "" || e.used.Before(h.entries[oldest].used) {
+				oldest = token
+			}
+		}
+		h.drop(oldest)
+	}
+}
+
+func (h *haves) drop(token string) {
+	h.size -= h.entries[token].size
+	delete(h.entries, token)
+}
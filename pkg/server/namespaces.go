@@ -0,0 +1,204 @@
+package server
+
+import (
+	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
+	"dag-poll/pkg/protocol"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Names of namespaces, safe as a path segment and a file name
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ValidNamespace reports whether name can be used as a namespace.
+func ValidNamespace(name string) bool {
+	return namespaceName.MatchString(name) && name != "." && name != ".."
+}
+
+// Namespaces serves independent DAGs side by side, each one under
+// /ns/{name}/ with the same API as a Server. Payloads with the same
+// PayloadID are kept in memory once across namespaces. Options.VersionPath is
+// the directory of the {name}.version files of the namespaces.
+type Namespaces struct {
+	opts     Options
+	payloads payloadStore
+
+	rw      sync.RWMutex
+	servers map[string]*Server
+}
+
+func NewNamespaces(opts Options) *Namespaces {
+	return &Namespaces{
+		opts:     opts,
+		payloads: payloadStore{m: make(map[mkdag.PayloadID]mkdag.Payload)},
+		servers:  make(map[string]*Server),
+	}
+}
+
+// Publish serves d in the namespace, created if it does not exist yet. See
+// Server.Publish, nil is returned if aborted by the next Publish to the same
+// namespace. Fails if the namespace can not be created, see NewServer, or if
+// d is refused.
+func (n *Namespaces) Publish(name string, d *dag.DAG) (*mkdag.MerkleDAG, error) {
+	n.rw.Lock()
+	s, ok := n.servers[name]
+	if !ok {
+		opts := n.opts
+		if opts.VersionPath != "" {
+			opts.VersionPath = filepath.Join(n.opts.VersionPath, name+".version")
+		}
+		var err error
+		if s, err = NewServer(opts); err != nil {
+			n.rw.Unlock()
+			return nil, err
+		}
+		n.servers[name] = s
+	}
+	n.rw.Unlock()
+
+	n.payloads.intern(d)
+	v, err := s.Publish(d)
+	n.sweep()
+	return v, err
+}
+
+// Get returns the Server of the namespace, nil if it does not exist.
+func (n *Namespaces) Get(name string) *Server {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+
+	return n.servers[name]
+}
+
+// Remove stops serving the namespace, its observers get 404 from then on.
+func (n *Namespaces) Remove(name string) {
+	n.rw.Lock()
+	delete(n.servers, name)
+	n.rw.Unlock()
+
+	n.sweep()
+}
+
+// Names returns the served namespaces in order.
+func (n *Namespaces) Names() []string {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+
+	names := make([]string, 0, len(n.servers))
+	for name := range n.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (n *Namespaces) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ns" || r.URL.Path == "/ns/" {
+		if r.Method != "GET" {
+			http.Error(w, protocol.Error("Method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", protocol.ContentTypeJSON)
+		resp := protocol.NamespacesResponse{Namespaces: n.Names()}
+		if err := resp.Pipe(w); err != nil {
+			http.Error(w, protocol.Error("Failed to encode data"), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/ns/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	name, _, _ := strings.Cut(rest, "/")
+
+	s := n.Get(name)
+	if s == nil {
+		http.Error(w, protocol.Error("Namespace not found"), http.StatusNotFound)
+		return
+	}
+	http.StripPrefix("/ns/"+name, s).ServeHTTP(w, r)
+}
+
+// Drop the payloads no longer served by any namespace once the store doubled
+// since the last sweep, so it costs no more than the publishes filling it.
+func (n *Namespaces) sweep() {
+	if !n.payloads.full() {
+		return
+	}
+
+	n.rw.RLock()
+	servers := make([]*Server, 0, len(n.servers))
+	for _, s := range n.servers {
+		servers = append(servers, s)
+	}
+	n.rw.RUnlock()
+
+	live := make(map[mkdag.PayloadID]struct{})
+	for _, s := range servers {
+		s.state.eachPayloadID(func(payloadID mkdag.PayloadID) {
+			live[payloadID] = struct{}{}
+		})
+	}
+	n.payloads.retain(live)
+}
+
+// payloadStore interns payloads by PayloadID, which is the ID of the DAG node
+// holding it, so that the DAGs and MerkleDAGs of every namespace share a
+// single copy.
+type payloadStore struct {
+	mu sync.Mutex
+	m  map[mkdag.PayloadID]mkdag.Payload
+	// Size after the last sweep
+	swept int
+}
+
+// Under this many payloads the store is never swept
+const minPayloadStoreSweep = 1024
+
+func (p *payloadStore) intern(d *dag.DAG) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range d.Nodes {
+		node := &d.Nodes[i]
+		payload, ok := p.m[node.ID]
+		if !ok {
+			p.m[node.ID] = node.Payload
+			continue
+		}
+		// Compared rather than trusting the ID, which a DAG file of one tenant
+		// could set to get the payload of another
+		if payload == node.Payload {
+			node.Payload = payload
+		}
+	}
+}
+
+func (p *payloadStore) full() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.m) >= minPayloadStoreSweep && len(p.m) >= 2*p.swept
+}
+
+// retain drops the payloads not in live. A payload interned after live was
+// collected may be dropped too, which only costs it being shared.
+func (p *payloadStore) retain(live map[mkdag.PayloadID]struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for payloadID := range p.m {
+		if _, ok := live[payloadID]; !ok {
+			delete(p.m, payloadID)
+		}
+	}
+	p.swept = len(p.m)
+}
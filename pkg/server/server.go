@@ -0,0 +1,167 @@
+package server
+
+import (
+	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	// Hash function of the MerkleDAGs generated by Publish, nil is the
+	// mkdag.DefaultHasher
+	Hasher mkdag.Hasher
+	// Number of published MerkleDAGs kept for in-flight syncs, the latest one
+	// included
+	HistorySize int
+	// Drop published MerkleDAGs older than this, the latest is always kept,
+	// 0 to disable
+	HistoryTTL time.Duration
+	// How long /root/watch holds the connection when the root does not
+	// change, 0 is 30 seconds
+	WatchTimeout time.Duration
+	// Responses smaller than this are not compressed, 0 is 1 KiB
+	CompressMinSize    int
+	DisableCompression bool
+	// File persisting the last Version assigned, so it keeps increasing
+	// across restarts. Empty to start from 1 on every start, which observers
+	// of the previous run take as older than what they have.
+	VersionPath string
+	// Also serve the GET with a JSON body forms of /sources, /query, /payload
+	// and /payloads, for observers older than the path and POST ones
+	Compat bool
+	// Where the published MerkleDAGs and the publish errors are logged, nil
+	// to discard
+	Logger *log.Logger
+}
+
+// Server serves the published MerkleDAGs to observers.
+type Server struct {
+	state        state
+	hasher       mkdag.Hasher
+	watchTimeout time.Duration
+	mux          *http.ServeMux
+	handler      http.Handler
+	// MerkleIDs registered by observers for their queries
+	haves haves
+
+	mu sync.Mutex
+	// Closed by the next Publish, which supersedes the one in progress
+	abort chan struct{}
+}
+
+// NewServer fails if the VersionPath can not be read, as Versions assigned
+// from scratch would go back to ones observers already have.
+func NewServer(opts Options) (*Server, error) {
+	s := &Server{
+		hasher:       opts.Hasher,
+		watchTimeout: opts.WatchTimeout,
+		mux:          http.NewServeMux(),
+		abort:        make(chan struct{}),
+	}
+	if s.hasher == nil {
+		s.hasher = mkdag.DefaultHasher
+	}
+	if s.watchTimeout <= 0 {
+		s.watchTimeout = 30 * time.Second
+	}
+	s.state.history = mkdag.NewHistory(opts.HistorySize, opts.HistoryTTL)
+	s.state.logger = opts.Logger
+	if opts.VersionPath != "" {
+		version, err := loadVersion(opts.VersionPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load version from %s: %w", opts.VersionPath, err)
+		}
+		s.state.version = version
+		s.state.versionPath = opts.VersionPath
+	}
+
+	s.mux.HandleFunc("GET /root", s.root)
+	s.mux.HandleFunc("GET /root/watch", s.rootWatch)
+	s.mux.HandleFunc("GET /sources/{root}", s.sources)
+	s.mux.HandleFunc("POST /query", s.query)
+	s.mux.HandleFunc("GET /query/{id}", s.node)
+	s.mux.HandleFunc("POST /have", s.have)
+	s.mux.HandleFunc("GET /payload/{id}", s.payload)
+	s.mux.HandleFunc("POST /payloads", s.payloads)
+	s.mux.HandleFunc("GET /diff", s.diff)
+	s.mux.HandleFunc("GET /delta", s.delta)
+	if opts.Compat {
+		s.mux.HandleFunc("GET /sources", s.legacySources)
+		s.mux.HandleFunc("GET /query", s.query)
+		s.mux.HandleFunc("GET /payload", s.legacyPayload)
+		s.mux.HandleFunc("GET /payloads", s.payloads)
+	}
+
+	s.handler = s.mux
+	if !opts.DisableCompression {
+		minSize := opts.CompressMinSize
+		if minSize <= 0 {
+			minSize = defaultCompressMinSize
+		}
+		s.handler = compress(s.mux, minSize)
+	}
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Publish generates the MerkleDAG of d and serves it with the next Version,
+// only rehashing what changed since the previous one. A Publish in progress is aborted by the
+// next one, nil is returned if this one got aborted.
+//
+// d is refused if the ID of a node it adds or updates is not the hash of its
+// payload, observers verify the PayloadIDs with the hash function of the
+// Merkle IDs and would reject it.
+//
+// d is copied, the caller may change it once Publish returns. It may be the
+// DAG of the previous Publish changed in place, the Changes recorded by the
+// dag mutation API are taken, and only applied if nothing else changed it.
+func (s *Server) Publish(d *dag.DAG) (*mkdag.MerkleDAG, error) {
+	s.mu.Lock()
+	close(s.abort)
+	abort := make(chan struct{})
+	s.abort = abort
+	s.mu.Unlock()
+
+	cs := d.TakeChanges()
+	d = d.Clone()
+
+	v, err := s.state.generate(d, cs, s.hasher, abort)
+	if err != nil {
+		return nil, fmt.Errorf("node IDs are not %s hashes of the payloads: %w", s.hasher.Name(), err)
+	}
+	if v == nil {
+		return nil, nil
+	}
+
+	if !s.state.apply(v, d, abort) {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// PublishMerkle serves an already generated MerkleDAG, e.g. one loaded from
+// a store.Store or synced from another observable. A Version it has is served
+// as is, so observers of a relay see the Version of the origin, one is
+// assigned otherwise.
+func (s *Server) PublishMerkle(m *mkdag.MerkleDAG) {
+	s.mu.Lock()
+	close(s.abort)
+	abort := make(chan struct{})
+	s.abort = abort
+	s.mu.Unlock()
+
+	s.state.apply(m, nil, abort)
+}
+
+// Root returns the root of the MerkleDAG being served, empty if none.
+func (s *Server) Root() string {
+	return s.state.Root()
+}
@@ -0,0 +1,843 @@
+package server_test
+
+import (
+	"context"
+	"dag-poll/pkg/client"
+	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
+	"dag-poll/pkg/protocol"
+	"dag-poll/pkg/server"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func newServer(t *testing.T, opts server.Options) (*server.Server, *client.Client) {
+	t.Helper()
+
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	c, err := client.New(client.Options{Endpoint: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+func publish(t *testing.T, s *server.Server, d *dag.DAG) *mkdag.MerkleDAG {
+	t.Helper()
+
+	m, err := s.Publish(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestPublish(t *testing.T) {
+	ctx := context.Background()
+	s, c := newServer(t, server.Options{Hasher: mkdag.SHA256})
+
+	if _, err := c.Root(ctx); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("expected no root, err: %v", err)
+	}
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100, HashPayload: mkdag.PayloadHashFunc(mkdag.SHA256)})
+	m := publish(t, s, d)
+
+	root, err := c.Root(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.ID != m.RootMerkleID || root.Hash != mkdag.SHA256.Name() {
+		t.Fatalf("unexpected root: %v", root)
+	}
+
+	sources, err := c.Sources(ctx, root.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sources.Size != len(m.Sources) {
+		t.Fatalf("len(sources) not match, expected: %d, actual: %d", len(m.Sources), sources.Size)
+	}
+
+	// Walk the whole MerkleDAG through the API
+	var merkleIDs []string
+	for _, source := range sources.Sources {
+		merkleIDs = append(merkleIDs, source.ID)
+	}
+	visited := make(map[string]bool)
+	for len(merkleIDs) > 0 {
+		resp, err := c.Query(ctx, root.ID, merkleIDs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		merkleIDs = nil
+		for merkleID, items := range resp {
+			visited[merkleID] = true
+			if len(items) != len(m.Children(merkleID)) {
+				t.Fatalf("children not match, merkle_id: %s", merkleID)
+			}
+			for _, item := range items {
+				if !visited[item.MerkleID] {
+					merkleIDs = append(merkleIDs, item.MerkleID)
+				}
+			}
+		}
+	}
+	if len(visited) != m.MerkleGraph.Len() {
+		t.Fatalf("len(MerkleGraph) not match, expected: %d, actual: %d", m.MerkleGraph.Len(), len(visited))
+	}
+
+	payload, err := c.Payload(ctx, root.ID, d.Nodes[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Payload != d.Nodes[0].Payload {
+		t.Errorf("payload not match, payload_id: %s", d.Nodes[0].ID)
+	}
+}
+
+func TestPublishHistory(t *testing.T) {
+	ctx := context.Background()
+	s, c := newServer(t, server.Options{HistorySize: 2})
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	prev := publish(t, s, d)
+
+	next := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	publish(t, s, next)
+
+	if s.Root() == prev.RootMerkleID {
+		t.Fatalf("root not changed")
+	}
+	if _, err := c.Sources(ctx, prev.RootMerkleID); err != nil {
+		t.Errorf("previous root not served, err: %s", err)
+	}
+}
+
+func TestPublishInPlace(t *testing.T) {
+	s, _ := newServer(t, server.Options{HistorySize: 2})
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	prev := publish(t, s, d)
+
+	id := mkdag.HashPayload(nil, []byte("new"))
+	if err := d.AddNode(dag.Node{ID: id, Payload: "bmV3"}, d.Nodes[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RemoveNode(d.Nodes[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	next := publish(t, s, d)
+
+	if next.RootMerkleID != mkdag.GenerateMerkleDAG(d, nil, nil).RootMerkleID {
+		t.Errorf("changes of the published DAG not applied")
+	}
+	if len(d.Changes) != 0 {
+		t.Errorf("changes not taken, %d left", len(d.Changes))
+	}
+	// Left untouched
+	if prev.RootMerkleID == next.RootMerkleID || prev.PayloadMap.Has(id) || !next.PayloadMap.Has(id) {
+		t.Errorf("previous MerkleDAG changed")
+	}
+}
+
+func TestPublishMutated(t *testing.T) {
+	s, _ := newServer(t, server.Options{HistorySize: 2})
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	publish(t, s, d)
+
+	// Changed in place, with and without the mutation API
+	id := mkdag.HashPayload(nil, []byte("new"))
+	if err := d.AddNode(dag.Node{ID: id, Payload: "bmV3"}, d.Nodes[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	d.AddRandomNodes(10)
+	// An edge to a node with another parent, so it stays reachable
+	inDegree := make(map[string]int)
+	for _, edge := range d.Edges {
+		inDegree[edge.To]++
+	}
+	i := slices.IndexFunc(d.Edges, func(edge dag.Edge) bool { return inDegree[edge.To] > 1 })
+	if i < 0 {
+		t.Fatal("no node with two parents")
+	}
+	d.Edges = slices.Delete(d.Edges, i, i+1)
+	expected := mkdag.GenerateMerkleDAG(d.Clone(), nil, nil)
+	if m := publish(t, s, d); m.RootMerkleID != expected.RootMerkleID {
+		t.Errorf("changes without the mutation API not applied")
+	}
+
+	// Not changed by the caller once published
+	d.DeleteRandomNodes(10)
+	if s.Root() != expected.RootMerkleID {
+		t.Fatalf("published DAG changed")
+	}
+	expected = mkdag.GenerateMerkleDAG(d.Clone(), nil, nil)
+	if m := publish(t, s, d); m.RootMerkleID != expected.RootMerkleID {
+		t.Errorf("changes since the last Publish not applied")
+	}
+}
+
+func TestPublishUnverified(t *testing.T) {
+	s, _ := newServer(t, server.Options{})
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	prev := publish(t, s, d)
+
+	// Changed in place
+	if err := d.AddNode(dag.Node{ID: "new", Payload: "bmV3"}, d.Nodes[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	var verifyErr *mkdag.VerifyError
+	if _, err := s.Publish(d); !errors.As(err, &verifyErr) || verifyErr.ID != "new" {
+		t.Errorf("expected the added node to be refused, err: %v", err)
+	}
+
+	// Replaced
+	next := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	next.Nodes[0].Payload = "bmV3"
+	if _, err := s.Publish(next); !errors.As(err, &verifyErr) || verifyErr.ID != next.Nodes[0].ID {
+		t.Errorf("expected the changed node to be refused, err: %v", err)
+	}
+
+	if s.Root() != prev.RootMerkleID {
+		t.Errorf("refused DAG served")
+	}
+}
+
+func TestPublishMerkle(t *testing.T) {
+	s, c := newServer(t, server.Options{})
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	m := mkdag.GenerateMerkleDAG(d, nil, nil)
+	m.Version = 42
+	s.PublishMerkle(m)
+
+	root, err := c.Root(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Version != m.Version {
+		t.Errorf("version not propagated, expected: %d, actual: %d", m.Version, root.Version)
+	}
+
+	d.UpdateRandomNodes(10)
+	v := publish(t, s, d)
+
+	expected := mkdag.GenerateMerkleDAG(d, nil, nil)
+	if v.RootMerkleID != expected.RootMerkleID {
+		t.Errorf("root not match, expected: %s, actual: %s", expected.RootMerkleID, v.RootMerkleID)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	s, c := newServer(t, server.Options{WatchTimeout: 5 * time.Second})
+
+	prev := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+
+	published := make(chan *mkdag.MerkleDAG, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		m, _ := s.Publish(dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+		published <- m
+	}()
+
+	root, err := c.WatchRoot(ctx, prev.RootMerkleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := <-published; root.ID != m.RootMerkleID {
+		t.Errorf("root not match, expected: %s, actual: %s", m.RootMerkleID, root.ID)
+	}
+}
+
+func TestBinary(t *testing.T) {
+	ctx := context.Background()
+	s, err := server.NewServer(server.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	m := publish(t, s, d)
+
+	jsonClient, err := client.New(client.Options{Endpoint: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryClient, err := client.New(client.Options{Endpoint: ts.URL, Binary: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var merkleIDs, payloadIDs []string
+	m.MerkleGraph.Range(func(merkleID mkdag.MerkleID, _ []*mkdag.Node) bool {
+		merkleIDs = append(merkleIDs, merkleID)
+		return true
+	})
+	m.PayloadMap.Range(func(payloadID mkdag.PayloadID, _ mkdag.Payload) bool {
+		payloadIDs = append(payloadIDs, payloadID)
+		return true
+	})
+
+	req, err := http.NewRequest("POST", ts.URL+"/query", strings.NewReader(`["`+merkleIDs[0]+`"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", protocol.ContentTypeBinary)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !protocol.IsBinary(resp) {
+		t.Errorf("expected binary response, Content-Type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	for _, c := range []*client.Client{jsonClient, binaryClient} {
+		sources, err := c.Sources(ctx, m.RootMerkleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sources.Size != len(m.Sources) || sources.Sources[0].ID == "" {
+			t.Errorf("unexpected sources: %v", sources)
+		}
+
+		query, err := c.Query(ctx, m.RootMerkleID, merkleIDs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.MerkleGraph.Range(func(merkleID mkdag.MerkleID, nodes []*mkdag.Node) bool {
+			if len(query[merkleID]) != len(nodes) {
+				t.Fatalf("children not match, merkle_id: %s", merkleID)
+			}
+			return true
+		})
+
+		payloads, err := c.Payloads(ctx, m.RootMerkleID, payloadIDs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.PayloadMap.Range(func(payloadID mkdag.PayloadID, payload mkdag.Payload) bool {
+			if payloads.Payloads[payloadID] != payload {
+				t.Fatalf("payload not match, payload_id: %s", payloadID)
+			}
+			return true
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s, err := server.NewServer(server.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	m := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+	var merkleIDs []string
+	m.MerkleGraph.Range(func(merkleID mkdag.MerkleID, _ []*mkdag.Node) bool {
+		merkleIDs = append(merkleIDs, `"`+merkleID+`"`)
+		return true
+	})
+	body := "[" + strings.Join(merkleIDs, ",") + "]"
+
+	tests := []struct {
+		method         string
+		path           string
+		acceptEncoding string
+		expected       string
+	}{
+		{"POST", "/query", "gzip", "gzip"},
+		{"POST", "/query", "gzip, zstd", "zstd"},
+		{"POST", "/query", "zstd;q=0, gzip", "gzip"},
+		{"POST", "/query", "zstd; q=0.00, gzip;q=0.5", "gzip"},
+		{"POST", "/query", "zstd;q=0.001", "zstd"},
+		{"POST", "/query", "br", ""},
+		// Too small to be compressed
+		{"GET", "/root", "gzip, zstd", ""},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, ts.URL+test.path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s failed, status: %d", test.path, resp.StatusCode)
+		}
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != test.expected {
+			t.Errorf("%s with %q, expected: %q, actual: %q", test.path, test.acceptEncoding, test.expected, encoding)
+		}
+	}
+}
+
+func TestCompat(t *testing.T) {
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+
+	for _, compat := range []bool{false, true} {
+		s, err := server.NewServer(server.Options{Compat: compat})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(s)
+		t.Cleanup(ts.Close)
+		m := publish(t, s, d)
+
+		var payloadID string
+		m.PayloadMap.Range(func(id mkdag.PayloadID, _ mkdag.Payload) bool {
+			payloadID = id
+			return false
+		})
+
+		tests := []struct {
+			method   string
+			path     string
+			body     string
+			isLegacy bool
+		}{
+			{"GET", "/sources/" + m.RootMerkleID, "", false},
+			{"POST", "/query", `["` + m.Sources[0].MerkleID + `"]`, false},
+			{"GET", "/payload/" + payloadID, "", false},
+			{"POST", "/payloads", `["` + payloadID + `"]`, false},
+			{"GET", "/sources", `{"id":"` + m.RootMerkleID + `"}`, true},
+			{"GET", "/query", `["` + m.Sources[0].MerkleID + `"]`, true},
+			{"GET", "/payload", `{"payload_id":"` + payloadID + `"}`, true},
+			{"GET", "/payloads", `["` + payloadID + `"]`, true},
+		}
+
+		for _, test := range tests {
+			req, err := http.NewRequest(test.method, ts.URL+test.path, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			served := resp.StatusCode == http.StatusOK
+			if served != (compat || !test.isLegacy) {
+				t.Errorf("%s %s with compat %v, status: %d", test.method, test.path, compat, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	s, err := server.NewServer(server.Options{Compat: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	m := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+	merkleID := m.Sources[0].MerkleID
+	payloadID := m.Sources[0].PayloadID
+
+	get := func(path, body, ifNoneMatch string, accept ...string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		for _, v := range accept {
+			req.Header.Add("Accept", v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for _, id := range []string{merkleID, payloadID} {
+		path := "/query/" + id
+		if id == payloadID {
+			path = "/payload/" + id
+		}
+
+		resp := get(path, "", "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s failed, status: %d", path, resp.StatusCode)
+		}
+		if etag := resp.Header.Get("ETag"); etag != `W/"`+id+`"` {
+			t.Errorf("%s ETag not match, actual: %s", path, etag)
+		}
+		if vary := strings.Join(resp.Header.Values("Vary"), ", "); vary != "Accept-Encoding, Accept" {
+			t.Errorf("%s Vary not match, actual: %s", path, vary)
+		}
+		if !strings.Contains(resp.Header.Get("Cache-Control"), "immutable") {
+			t.Errorf("%s not immutable, Cache-Control: %s", path, resp.Header.Get("Cache-Control"))
+		}
+
+		if resp := get(path, "", `"other", W/"`+id+`"`); resp.StatusCode != http.StatusNotModified {
+			t.Errorf("%s If-None-Match not honored, status: %d", path, resp.StatusCode)
+		}
+		if resp := get(path, "", `"other"`); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s unexpected status: %d", path, resp.StatusCode)
+		}
+
+		// The binary encoding is another representation
+		resp = get(path, "", `W/"`+id+`"`, protocol.ContentTypeBinary)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s JSON tag matched the binary encoding, status: %d", path, resp.StatusCode)
+		}
+		if etag := resp.Header.Get("ETag"); etag != `W/"`+id+`-bin"` {
+			t.Errorf("%s binary ETag not match, actual: %s", path, etag)
+		}
+		if resp := get(path, "", resp.Header.Get("ETag"), protocol.ContentTypeBinary); resp.StatusCode != http.StatusNotModified {
+			t.Errorf("%s binary If-None-Match not honored, status: %d", path, resp.StatusCode)
+		}
+	}
+
+	// Neither errors nor the legacy form, whose URL is the same for every
+	// payload, are cacheable
+	if resp := get("/query/unknown", "", ""); resp.StatusCode != http.StatusNotFound || resp.Header.Get("ETag") != "" {
+		t.Errorf("unknown node, status: %d, ETag: %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if resp := get("/payload", `{"payload_id":"`+payloadID+`"}`, ""); resp.Header.Get("Cache-Control") != "" {
+		t.Errorf("legacy payload cacheable, Cache-Control: %s", resp.Header.Get("Cache-Control"))
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	ctx := context.Background()
+	ns := server.NewNamespaces(server.Options{})
+	ts := httptest.NewServer(ns)
+	t.Cleanup(ts.Close)
+
+	a := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	// Same payloads, read separately from another file
+	data, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b dag.DAG
+	if err := json.Unmarshal(data, &b); err != nil {
+		t.Fatal(err)
+	}
+	b.UpdateRandomNodes(10)
+
+	ma, err := ns.Publish("a", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := ns.Publish("b", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := make(map[string]string)
+	for _, node := range a.Nodes {
+		payloads[node.ID] = node.Payload
+	}
+	var shared string
+	for _, node := range b.Nodes {
+		payload, ok := payloads[node.ID]
+		if !ok {
+			continue
+		}
+		shared = node.ID
+		if unsafe.StringData(node.Payload) != unsafe.StringData(payload) {
+			t.Fatalf("payload not shared, payload_id: %s", node.ID)
+		}
+	}
+	if names := ns.Names(); len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("unexpected namespaces: %v", names)
+	}
+
+	for name, m := range map[string]*mkdag.MerkleDAG{"a": ma, "b": mb} {
+		c, err := client.New(client.Options{Endpoint: ts.URL + "/ns/" + name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := c.Root(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.ID != m.RootMerkleID {
+			t.Errorf("root of %s not match, expected: %s, actual: %s", name, m.RootMerkleID, root.ID)
+		}
+		if _, err := c.Payload(ctx, root.ID, shared); err != nil {
+			t.Errorf("shared payload not served by %s, err: %v", name, err)
+		}
+	}
+
+	ns.Remove("a")
+	c, err := client.New(client.Options{Endpoint: ts.URL + "/ns/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Root(ctx); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("removed namespace served, err: %v", err)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "from.json.version")
+	s, err := server.NewServer(server.Options{HistorySize: 10, VersionPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	first := publish(t, s, d)
+	// Same root, same Version
+	if m := publish(t, s, d); m.Version != 1 || first.Version != 1 {
+		t.Fatalf("unexpected versions: %d, %d", first.Version, m.Version)
+	}
+
+	if m := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})); m.Version != 2 {
+		t.Fatalf("version not increased, actual: %d", m.Version)
+	}
+
+	// Carried over by the file
+	restarted, c := newServer(t, server.Options{VersionPath: path})
+	m := publish(t, restarted, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+	if m.Version != 3 || m.Timestamp == 0 {
+		t.Fatalf("version not persisted, version: %d, timestamp: %d", m.Version, m.Timestamp)
+	}
+
+	root, err := c.Root(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Version != m.Version || root.Timestamp != m.Timestamp {
+		t.Errorf("root version not match, expected: %d, actual: %d", m.Version, root.Version)
+	}
+
+	// Not started with a version file it can not read, it would assign
+	// Versions from 1 again
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.NewServer(server.Options{VersionPath: path}); err == nil {
+		t.Errorf("expected a corrupt version file to fail")
+	}
+
+	// Responses tell the Version of the MerkleDAG they are taken from
+	req, err := http.NewRequest("GET", ts.URL+"/sources/"+first.RootMerkleID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if v := resp.Header.Get(protocol.VersionHeader); v != "1" {
+		t.Errorf("unexpected %s: %q", protocol.VersionHeader, v)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	s, c := newServer(t, server.Options{HistorySize: 2})
+
+	prev := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100})
+	next := publish(t, s, d)
+
+	diff, err := c.Diff(ctx, prev.RootMerkleID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.To != next.RootMerkleID || len(diff.Added) != len(d.Nodes) || len(diff.AddedSources) != len(d.Sources) {
+		t.Errorf("unexpected diff, to: %s, added: %d, added sources: %d", diff.To, len(diff.Added), len(diff.AddedSources))
+	}
+
+	if _, err := c.Diff(ctx, "unknown", ""); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected not found, err: %v", err)
+	}
+}
+
+func TestDelta(t *testing.T) {
+	ctx := context.Background()
+	s, c := newServer(t, server.Options{HistorySize: 2})
+
+	prev := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+	next := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+
+	delta, err := c.Delta(ctx, prev.RootMerkleID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing in common with prev
+	if delta.To != next.RootMerkleID || len(delta.Nodes) != next.MerkleGraph.Len() || len(delta.Payloads) != next.PayloadMap.Len() {
+		t.Errorf("unexpected delta, to: %s, nodes: %d, payloads: %d", delta.To, len(delta.Nodes), len(delta.Payloads))
+	}
+
+	delta, err = c.Delta(ctx, next.RootMerkleID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Nodes) != 0 || len(delta.Payloads) != 0 {
+		t.Errorf("expected an empty delta, nodes: %d, payloads: %d", len(delta.Nodes), len(delta.Payloads))
+	}
+
+	if _, err := c.Delta(ctx, "unknown", ""); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected not found, err: %v", err)
+	}
+}
+
+func TestQueryDepth(t *testing.T) {
+	ctx := context.Background()
+	s, c := newServer(t, server.Options{})
+	m := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 200}))
+
+	var merkleIDs []string
+	for _, source := range m.Sources {
+		merkleIDs = append(merkleIDs, source.MerkleID)
+	}
+
+	// Every Merkle node within 3 levels of the sources
+	expected := make(map[string]bool)
+	level := merkleIDs
+	for depth := 0; depth < 3; depth++ {
+		var next []string
+		for _, merkleID := range level {
+			expected[merkleID] = true
+			for _, child := range m.Children(merkleID) {
+				next = append(next, child.MerkleID)
+			}
+		}
+		level = next
+	}
+
+	resp, err := c.QueryTree(ctx, m.RootMerkleID, 3, protocol.QueryTreeRequest{IDs: merkleIDs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != len(expected) {
+		t.Errorf("unexpected number of nodes, expected: %d, actual: %d", len(expected), len(resp))
+	}
+	for merkleID := range resp {
+		if !expected[merkleID] {
+			t.Errorf("node deeper than 3 levels, merkle_id: %s", merkleID)
+		}
+	}
+
+	// The subtrees of the nodes the client has are left out
+	var have []string
+	for _, child := range m.Children(merkleIDs[0]) {
+		have = append(have, child.MerkleID)
+	}
+	resp, err = c.QueryTree(ctx, m.RootMerkleID, 2, protocol.QueryTreeRequest{IDs: merkleIDs[:1], Have: have})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 {
+		t.Errorf("expected only the queried node, got: %d", len(resp))
+	}
+
+	// Or in a filter of every node but the sources
+	filter := protocol.NewBloomFilter(m.MerkleGraph.Len(), 0.001)
+	m.MerkleGraph.Range(func(merkleID mkdag.MerkleID, _ []*mkdag.Node) bool {
+		if !slices.Contains(merkleIDs, merkleID) {
+			filter.Add(merkleID)
+		}
+		return true
+	})
+	resp, err = c.QueryTree(ctx, m.RootMerkleID, 3, protocol.QueryTreeRequest{IDs: merkleIDs, HaveFilter: filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != len(merkleIDs) {
+		t.Errorf("expected only the queried nodes, got: %d", len(resp))
+	}
+
+	// A token the observable does not have is gone, the client registers
+	// the filter again
+	body := `{"ids":["` + merkleIDs[0] + `"],"have_token":"unknown"}`
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/query?depth=2", strings.NewReader(body)))
+	if w.Code != http.StatusGone {
+		t.Errorf("unknown token, status: %d", w.Code)
+	}
+}
+
+func TestQueryMaxNodes(t *testing.T) {
+	ctx := context.Background()
+	s, c := newServer(t, server.Options{})
+	m := publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 15000}))
+
+	var merkleIDs []string
+	for _, source := range m.Sources {
+		merkleIDs = append(merkleIDs, source.MerkleID)
+	}
+
+	// Capped within a level, the queried nodes are always there
+	resp, err := c.QueryTree(ctx, m.RootMerkleID, 100, protocol.QueryTreeRequest{IDs: merkleIDs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 10000 {
+		t.Errorf("expected the cap of 10000 nodes, got: %d", len(resp))
+	}
+	for _, merkleID := range merkleIDs {
+		if _, ok := resp[merkleID]; !ok {
+			t.Errorf("queried node left out, merkle_id: %s", merkleID)
+		}
+	}
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	s, err := server.NewServer(server.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, s, dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 100}))
+
+	// A single string, refused before the whole body is decoded
+	large := `"` + strings.Repeat("a", 9<<20) + `"`
+	for _, test := range []struct{ path, body string }{
+		{"/have", `{"have":[` + large + `]}`},
+		{"/query", `{"ids":[` + large + `]}`},
+		{"/payloads", `[` + large + `]`},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", test.path, strings.NewReader(test.body)))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s, expected 413, status: %d", test.path, w.Code)
+		}
+	}
+}
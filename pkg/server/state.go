@@ -0,0 +1,374 @@
+package server
+
+import (
+	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
+	"fmt"
+	"log"
+	"sync"
+)
+
+type state struct {
+	rw sync.RWMutex
+	*mkdag.MerkleDAG
+	// Copy of the DAG the MerkleDAG was generated from, never changed
+	dag *dag.DAG
+	// Closed and replaced every time a new MerkleDAG is applied
+	changed chan struct{}
+	// Previously applied MerkleDAGs, for syncs started before the last apply
+	history *mkdag.History
+	// Last Version assigned, and the file it is persisted to, empty for none
+	version     versionHead
+	versionPath string
+	// nil to discard
+	logger *log.Logger
+}
+
+func (m *state) logf(format string, v ...any) {
+	if m.logger != nil {
+		m.logger.Printf(format, v...)
+	}
+}
+
+// apply makes v the current MerkleDAG unless abort is closed, d is the DAG it
+// was generated from, nil if unknown.
+func (m *state) apply(v *mkdag.MerkleDAG, d *dag.DAG, abort chan struct{}) bool {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	select {
+	case <-abort:
+		return false
+	default:
+	}
+
+	if m.version.assign(v) && m.versionPath != "" {
+		if err := saveVersion(m.versionPath, m.version); err != nil {
+			m.logf("failed to save version, err: %s", err)
+		}
+	}
+
+	m.MerkleDAG = v
+	m.dag = d
+	m.history.Push(v)
+	if m.changed != nil {
+		close(m.changed)
+		m.changed = nil
+	}
+	m.logf("MerkleDAG loaded, root: %s, version: %d", v.RootMerkleID, v.Version)
+	return true
+}
+
+// Only rehash the changed part of the DAG if there is a previous one,
+// fallback to a full generation otherwise. d is a snapshot of the published
+// DAG, and cs the changes recorded by the mutation API on it since the
+// previous Publish; they are applied as is if they turn the previous DAG into
+// d, which is not the case if it was also changed otherwise, e.g. by
+// AddRandomNodes, and d is diffed against the previous DAG instead. Fails if
+// a node ID is not the hash of its payload, only the added and updated nodes
+// are checked when there is a previous one.
+func (m *state) generate(d *dag.DAG, cs dag.ChangeSet, hasher mkdag.Hasher, abort chan struct{}) (*mkdag.MerkleDAG, error) {
+	m.rw.RLock()
+	prev, prevDAG := m.MerkleDAG, m.dag
+	m.rw.RUnlock()
+
+	if prev == nil || prev.GetHasher() != hasher {
+		return generateVerified(d, hasher, abort)
+	}
+	if prevDAG == nil {
+		// Published by PublishMerkle
+		prevDAG = prev.ToDAG()
+	}
+
+	var v *mkdag.MerkleDAG
+	var err error
+	if len(cs) > 0 && explains(prevDAG, cs, d) {
+		if err := mkdag.VerifyChangeSet(hasher, cs); err != nil {
+			return nil, err
+		}
+		v, err = prev.ApplyChangeSet(cs, d.Sources)
+	} else {
+		added, removed, updated := mkdag.DiffDAG(prevDAG, d)
+		if err := mkdag.VerifyChanges(hasher, added, updated); err != nil {
+			return nil, err
+		}
+		v, err = prev.ApplyChanges(added, removed, updated)
+	}
+	if err != nil {
+		m.logf("failed to apply changes, regenerate MerkleDAG, err: %s", err)
+		return generateVerified(d, hasher, abort)
+	}
+
+	return v, nil
+}
+
+// explains is true if replaying cs on prev gives next.
+func explains(prev *dag.DAG, cs dag.ChangeSet, next *dag.DAG) bool {
+	replayed := prev.Clone()
+	if err := cs.Replay(replayed); err != nil {
+		return false
+	}
+	added, removed, updated := mkdag.DiffDAG(replayed, next)
+	return len(added.Nodes) == 0 && len(added.Edges) == 0 && len(added.Sources) == 0 &&
+		len(removed.Nodes) == 0 && len(removed.Edges) == 0 && len(removed.Sources) == 0 &&
+		len(updated) == 0
+}
+
+func generateVerified(d *dag.DAG, hasher mkdag.Hasher, abort chan struct{}) (*mkdag.MerkleDAG, error) {
+	if err := mkdag.VerifyDAG(hasher, d); err != nil {
+		return nil, err
+	}
+	return mkdag.GenerateMerkleDAG(d, hasher, abort), nil
+}
+
+// eachPayloadID calls f with the PayloadIDs of every MerkleDAG still served.
+func (m *state) eachPayloadID(f func(mkdag.PayloadID)) {
+	for _, snapshot := range m.history.Snapshots() {
+		snapshot.PayloadMap.Range(func(payloadID mkdag.PayloadID, _ mkdag.Payload) bool {
+			f(payloadID)
+			return true
+		})
+	}
+}
+
+func (m *state) Root() string {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	if m.MerkleDAG == nil {
+		return ""
+	}
+
+	return m.RootMerkleID
+}
+
+// Head returns the current MerkleDAG, nil if there is none. Its fields but
+// the maps are not changed once applied.
+func (m *state) Head() *mkdag.MerkleDAG {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	return m.MerkleDAG
+}
+
+// Version returns the Version of the MerkleDAG with the root, ok is false if
+// the root is unknown.
+func (m *state) Version(root string) (version int64, ok bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	snapshot := m.snapshot(root)
+	if snapshot == nil {
+		return 0, false
+	}
+	return snapshot.Version, true
+}
+
+// Watch returns a channel closed once the root is different from since.
+func (m *state) Watch(since string) <-chan struct{} {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	if m.MerkleDAG != nil && m.RootMerkleID != since {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+
+	if m.changed == nil {
+		m.changed = make(chan struct{})
+	}
+	return m.changed
+}
+
+type QueryItem struct {
+	MerkleID  string
+	PayloadID string
+}
+
+// The MerkleDAG with the root, the current one if root is empty.
+// Must be called with m.rw held.
+func (m *state) snapshot(root string) *mkdag.MerkleDAG {
+	if m.MerkleDAG == nil {
+		return nil
+	}
+	if root == "" || root == m.RootMerkleID {
+		return m.MerkleDAG
+	}
+
+	return m.history.Get(root)
+}
+
+// Max number of Merkle nodes in the response to a query with a depth, the
+// rest of the deeper levels is left for the next query. The queried nodes are
+// always answered.
+const maxQueryNodes = 10000
+
+// Query returns the children of the merkleIDs in the MerkleDAG with the root,
+// ok is false if the root is unknown. With a depth over 1 the children of
+// the children are returned too, down to depth levels, except for the
+// subtrees of the MerkleIDs have is true for, nil for none.
+func (m *state) Query(root string, merkleIDs []string, depth int, have func(mkdag.MerkleID) bool) (r map[string][]QueryItem, ok bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	snapshot := m.snapshot(root)
+	if snapshot == nil {
+		return nil, false
+	}
+
+	r = make(map[string][]QueryItem, len(merkleIDs))
+	level := merkleIDs
+	for first := true; depth > 0 && len(level) > 0; depth-- {
+		var next []string
+		for _, merkleID := range level {
+			if !first && len(r) >= maxQueryNodes {
+				return r, true
+			}
+			if _, ok := r[merkleID]; ok {
+				continue
+			}
+
+			nodes, ok := snapshot.MerkleGraph.Get(merkleID)
+			if !ok {
+				r[merkleID] = []QueryItem{}
+				continue
+			}
+
+			v := []QueryItem{}
+			for _, node := range nodes {
+				item := QueryItem{
+					MerkleID:  node.MerkleID,
+					PayloadID: node.PayloadID,
+				}
+				v = append(v, item)
+
+				if have == nil || !have(node.MerkleID) {
+					next = append(next, node.MerkleID)
+				}
+			}
+
+			r[merkleID] = v
+		}
+
+		first = false
+		level = next
+	}
+
+	return r, true
+}
+
+// Node returns the children of a single Merkle node, nil if the MerkleDAG
+// with the root does not have it, ok is false if the root is unknown.
+func (m *state) Node(root string, merkleID string) (r []QueryItem, ok bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	snapshot := m.snapshot(root)
+	if snapshot == nil {
+		return nil, false
+	}
+
+	nodes, ok := snapshot.MerkleGraph.Get(merkleID)
+	if !ok {
+		return nil, true
+	}
+
+	r = make([]QueryItem, 0, len(nodes))
+	for _, node := range nodes {
+		r = append(r, QueryItem{
+			MerkleID:  node.MerkleID,
+			PayloadID: node.PayloadID,
+		})
+	}
+	return r, true
+}
+
+// Diff returns what changed from the MerkleDAG with the root from to the one
+// with the root to, ok is false if either root is unknown.
+func (m *state) Diff(from, to string) (r *mkdag.MerkleDiff, ok bool, err error) {
+	m.rw.RLock()
+	prev, next := m.snapshot(from), m.snapshot(to)
+	m.rw.RUnlock()
+
+	if prev == nil || next == nil {
+		return nil, false, nil
+	}
+	if prev.GetHasher() != next.GetHasher() {
+		return nil, true, fmt.Errorf("hash functions differ, from: %s, to: %s", prev.GetHasher().Name(), next.GetHasher().Name())
+	}
+	return mkdag.Diff(prev, next), true, nil
+}
+
+// Delta returns the Merkle nodes and payloads of the MerkleDAG with the root
+// to that the one with the root from does not have, ok is false if either
+// root is unknown.
+func (m *state) Delta(from, to string) (nodes mkdag.MerkleGraph, payloads mkdag.PayloadMap, ok bool, err error) {
+	m.rw.RLock()
+	prev, next := m.snapshot(from), m.snapshot(to)
+	m.rw.RUnlock()
+
+	if prev == nil || next == nil {
+		return nodes, payloads, false, nil
+	}
+	if prev.GetHasher() != next.GetHasher() {
+		return nodes, payloads, true, fmt.Errorf("hash functions differ, from: %s, to: %s", prev.GetHasher().Name(), next.GetHasher().Name())
+	}
+	nodes, payloads = mkdag.Delta(prev, next)
+	return nodes, payloads, true, nil
+}
+
+func (m *state) Sources(root string) ([]mkdag.Source, bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	snapshot := m.snapshot(root)
+	if snapshot == nil {
+		return nil, false
+	}
+
+	if len(snapshot.Sources) == 0 {
+		return nil, true
+	}
+
+	return snapshot.Sources, true
+}
+
+func (m *state) Payload(root string, payloadID string) (r *string, ok bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	snapshot := m.snapshot(root)
+	if snapshot == nil {
+		return nil, false
+	}
+
+	payload, ok := snapshot.PayloadMap.Get(payloadID)
+	if !ok {
+		return nil, true
+	}
+
+	return &payload, true
+}
+
+func (m *state) Payloads(root string, payloadIDs []string) (found map[string]string, missing []string, ok bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	snapshot := m.snapshot(root)
+	if snapshot == nil {
+		return nil, nil, false
+	}
+
+	found = make(map[string]string, len(payloadIDs))
+	for _, payloadID := range payloadIDs {
+		payload, ok := snapshot.PayloadMap.Get(payloadID)
+		if !ok {
+			missing = append(missing, payloadID)
+			continue
+		}
+		found[payloadID] = payload
+	}
+
+	return found, missing, true
+}
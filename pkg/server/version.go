@@ -0,0 +1,67 @@
+package server
+
+import (
+	mkdag "dag-poll/pkg/merkledag"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// versionHead is the last Version assigned, persisted so that it keeps
+// increasing across restarts.
+type versionHead struct {
+	Version   int64          `json:"version"`
+	Timestamp int64          `json:"timestamp"`
+	Root      mkdag.MerkleID `json:"root"`
+}
+
+func loadVersion(path string) (versionHead, error) {
+	var v versionHead
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return v, err
+	}
+
+	err = json.Unmarshal(b, &v)
+	return v, err
+}
+
+func saveVersion(path string, v versionHead) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// assign gives m the next Version, or the last one again if it has the same
+// root. A MerkleDAG with a Version already, e.g. synced from another
+// observable, keeps it. Returns true if the last Version changed.
+func (v *versionHead) assign(m *mkdag.MerkleDAG) bool {
+	if m.Version == 0 {
+		if m.RootMerkleID == v.Root && v.Version > 0 {
+			m.Version, m.Timestamp = v.Version, v.Timestamp
+			return false
+		}
+		m.Version, m.Timestamp = v.Version+1, time.Now().Unix()
+	}
+
+	if m.Version < v.Version {
+		return false
+	}
+	*v = versionHead{Version: m.Version, Timestamp: m.Timestamp, Root: m.RootMerkleID}
+	return true
+}
@@ -0,0 +1,344 @@
+package store
+
+import (
+	mkdag "dag-poll/pkg/merkledag"
+	"dag-poll/pkg/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store persists a MerkleDAG in a content-addressed directory:
+//
+//	<dir>/head.json                 root, version and sources of the saved MerkleDAG
+//	<dir>/graph/<ab>/<merkle_id>    children of a Merkle node
+//	<dir>/payloads/<ab>/<payload_id> payload
+//
+// where <ab> are the first two characters of the ID. Entries are immutable,
+// so they are only written once, head.json is written last and commits a Save.
+// IDs are checked to be hashes of the hash function of the MerkleDAG before
+// they become file names.
+type Store struct {
+	dir string
+
+	mu sync.Mutex
+	// Hash function of the last saved or loaded MerkleDAG
+	hasher mkdag.Hasher
+	// Entries known to be on disk
+	merkleIDs  utils.Set[mkdag.MerkleID]
+	payloadIDs utils.Set[mkdag.PayloadID]
+}
+
+type head struct {
+	Hash         string         `json:"hash"`
+	Version      int64          `json:"version"`
+	Timestamp    int64          `json:"timestamp,omitempty"`
+	RootMerkleID mkdag.MerkleID `json:"root"`
+	Sources      []mkdag.Source `json:"sources"`
+}
+
+func Open(dir string) (*Store, error) {
+	for _, sub := range []string{"graph", "payloads"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Store{
+		dir:        dir,
+		merkleIDs:  make(utils.Set[mkdag.MerkleID]),
+		payloadIDs: make(utils.Set[mkdag.PayloadID]),
+	}, nil
+}
+
+func shard(id string) string {
+	if len(id) < 2 {
+		return "_"
+	}
+	return id[:2]
+}
+
+func (s *Store) headPath() string {
+	return filepath.Join(s.dir, "head.json")
+}
+
+func (s *Store) graphPath(merkleID mkdag.MerkleID) (string, error) {
+	if err := mkdag.CheckID(s.hasher, merkleID); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, "graph", shard(merkleID), merkleID), nil
+}
+
+func (s *Store) payloadPath(payloadID mkdag.PayloadID) (string, error) {
+	if err := mkdag.CheckID(s.hasher, payloadID); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, "payloads", shard(payloadID), payloadID), nil
+}
+
+// Write to a temporary file first, so a crash never leaves a partial entry.
+func writeFile(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Save writes the entries of m not on disk yet, makes m the head and removes
+// the entries of the previous head m does not reference.
+func (s *Store) Save(m *mkdag.MerkleDAG) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hasher = m.GetHasher()
+	var err error
+	m.MerkleGraph.Range(func(merkleID mkdag.MerkleID, nodes []*mkdag.Node) bool {
+		if s.merkleIDs.Contains(merkleID) {
+			return true
+		}
+
+		var b []byte
+		var path string
+		if b, err = json.Marshal(nodes); err != nil {
+			return false
+		}
+		if path, err = s.graphPath(merkleID); err != nil {
+			return false
+		}
+		if err = writeFile(path, b); err != nil {
+			return false
+		}
+		s.merkleIDs.Add(merkleID)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	m.PayloadMap.Range(func(payloadID mkdag.PayloadID, payload mkdag.Payload) bool {
+		if s.payloadIDs.Contains(payloadID) {
+			return true
+		}
+
+		var path string
+		if path, err = s.payloadPath(payloadID); err != nil {
+			return false
+		}
+		if err = writeFile(path, []byte(payload)); err != nil {
+			return false
+		}
+		s.payloadIDs.Add(payloadID)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(head{
+		Hash:         m.GetHasher().Name(),
+		Version:      m.Version,
+		Timestamp:    m.Timestamp,
+		RootMerkleID: m.RootMerkleID,
+		Sources:      m.Sources,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(s.headPath(), b); err != nil {
+		return err
+	}
+
+	return s.pruneKnown(m)
+}
+
+// Remove the entries written or read by this Store that m does not
+// reference, Prune also finds the ones left by a previous run.
+func (s *Store) pruneKnown(m *mkdag.MerkleDAG) error {
+	for merkleID := range s.merkleIDs {
+		if m.MerkleGraph.Has(merkleID) {
+			continue
+		}
+		if err := s.remove(s.graphPath(merkleID)); err != nil {
+			return err
+		}
+		s.merkleIDs.Remove(merkleID)
+	}
+	for payloadID := range s.payloadIDs {
+		if m.PayloadMap.Has(payloadID) {
+			continue
+		}
+		if err := s.remove(s.payloadPath(payloadID)); err != nil {
+			return err
+		}
+		s.payloadIDs.Remove(payloadID)
+	}
+	return nil
+}
+
+func (s *Store) remove(path string, err error) error {
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Load reads the MerkleDAG of the last Save, returns nil if there is none.
+// Entries referenced by the MerkleDAG but not on disk, e.g. invalidated since
+// the Save, or not matching their ID, e.g. damaged on disk, are left out of it
+// and their IDs returned as missing, for the caller to fetch again.
+func (s *Store) Load() (m *mkdag.MerkleDAG, missing []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := os.ReadFile(s.headPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var h head
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, nil, fmt.Errorf("failed unmarshalling head: %s", err)
+	}
+
+	hasher, err := mkdag.HasherByName(h.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.hasher = hasher
+
+	m = &mkdag.MerkleDAG{
+		Version:      h.Version,
+		Timestamp:    h.Timestamp,
+		RootMerkleID: h.RootMerkleID,
+		Sources:      h.Sources,
+		Hasher:       hasher,
+	}
+
+	var stack []mkdag.Node
+	for _, source := range h.Sources {
+		stack = append(stack, mkdag.Node{
+			MerkleID:  source.MerkleID,
+			PayloadID: source.PayloadID,
+		})
+	}
+
+	seen := make(utils.Set[string])
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if !m.PayloadMap.Has(node.PayloadID) && !seen.Contains(node.PayloadID) {
+			seen.Add(node.PayloadID)
+			path, err := s.payloadPath(node.PayloadID)
+			if err != nil {
+				return nil, nil, err
+			}
+			payload, err := os.ReadFile(path)
+			if errors.Is(err, os.ErrNotExist) {
+				missing = append(missing, node.PayloadID)
+			} else if err != nil {
+				return nil, nil, fmt.Errorf("failed reading payload %s: %s", node.PayloadID, err)
+			} else if mkdag.VerifyPayload(hasher, node.PayloadID, string(payload)) != nil {
+				missing = append(missing, node.PayloadID)
+			} else {
+				m.PayloadMap.Set(node.PayloadID, string(payload))
+				s.payloadIDs.Add(node.PayloadID)
+			}
+		}
+
+		if m.MerkleGraph.Has(node.MerkleID) || seen.Contains(node.MerkleID) {
+			continue
+		}
+		seen.Add(node.MerkleID)
+
+		path, err := s.graphPath(node.MerkleID)
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, node.MerkleID)
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed reading merkle node %s: %s", node.MerkleID, err)
+		}
+		var nodes []*mkdag.Node
+		if err := json.Unmarshal(b, &nodes); err != nil {
+			return nil, nil, fmt.Errorf("failed unmarshalling merkle node %s: %s", node.MerkleID, err)
+		}
+		children := make([]mkdag.MerkleID, len(nodes))
+		for i, child := range nodes {
+			children[i] = child.MerkleID
+		}
+		if mkdag.VerifyNode(hasher, node.MerkleID, node.PayloadID, children) != nil {
+			missing = append(missing, node.MerkleID)
+			continue
+		}
+		m.MerkleGraph.Set(node.MerkleID, nodes)
+		s.merkleIDs.Add(node.MerkleID)
+
+		for _, child := range nodes {
+			stack = append(stack, *child)
+		}
+	}
+
+	return m, missing, nil
+}
+
+// Invalidate removes the entry with the Merkle or payload ID, so the next
+// Save writes it again. Until then Load returns the ID as missing.
+func (s *Store) Invalidate(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.remove(s.graphPath(id)); err != nil {
+		return err
+	}
+	if err := s.remove(s.payloadPath(id)); err != nil {
+		return err
+	}
+	s.merkleIDs.Remove(id)
+	s.payloadIDs.Remove(id)
+	return nil
+}
+
+// Prune removes the entries not referenced by m.
+func (s *Store) Prune(m *mkdag.MerkleDAG) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prune := func(sub string, keep func(string) bool, known utils.Set[string]) error {
+		return filepath.WalkDir(filepath.Join(s.dir, sub), func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+
+			id := d.Name()
+			if keep(id) {
+				return nil
+			}
+			known.Remove(id)
+			return os.Remove(path)
+		})
+	}
+
+	if err := prune("graph", m.MerkleGraph.Has, s.merkleIDs); err != nil {
+		return err
+	}
+	return prune("payloads", m.PayloadMap.Has, s.payloadIDs)
+}
@@ -0,0 +1,275 @@
+package store_test
+
+import (
+	"dag-poll/pkg/dag"
+	mkdag "dag-poll/pkg/merkledag"
+	"dag-poll/pkg/store"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 200})
+	m := mkdag.GenerateMerkleDAG(d, nil, nil)
+
+	s, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(m); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, missing, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) > 0 {
+		t.Errorf("unexpected missing entries: %v", missing)
+	}
+
+	if v.RootMerkleID != m.RootMerkleID {
+		t.Errorf("root not match, expected: %s, actual: %s", m.RootMerkleID, v.RootMerkleID)
+	}
+	if !dag.IsEquals(d, v.ToDAG()) {
+		t.Errorf("loaded DAG is not equal")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 200})
+	m := mkdag.GenerateMerkleDAG(d, nil, nil)
+
+	s, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(m); err != nil {
+		t.Fatal(err)
+	}
+
+	d.UpdateRandomNodes(10)
+	next := mkdag.GenerateMerkleDAG(d, nil, nil)
+	if err := s.Save(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Prune(next); err != nil {
+		t.Fatal(err)
+	}
+
+	v, _, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dag.IsEquals(d, v.ToDAG()) {
+		t.Errorf("loaded DAG is not equal after prune")
+	}
+}
+
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSavePrunes(t *testing.T) {
+	dir := t.TempDir()
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 200})
+	s, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(mkdag.GenerateMerkleDAG(d, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	d.UpdateRandomNodes(10)
+	next := mkdag.GenerateMerkleDAG(d, nil, nil)
+	if err := s.Save(next); err != nil {
+		t.Fatal(err)
+	}
+
+	// The head and the entries of next only
+	expected := 1 + next.MerkleGraph.Len() + next.PayloadMap.Len()
+	if n := countFiles(t, dir); n != expected {
+		t.Errorf("previous entries not pruned, files: %d, expected: %d", n, expected)
+	}
+}
+
+func TestInvalidID(t *testing.T) {
+	dir := t.TempDir()
+	s, err := store.Open(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 20})
+	m := mkdag.GenerateMerkleDAG(d, nil, nil)
+	m.PayloadMap.Set("../../escaped", "aGVsbG8=")
+	if err := s.Save(m); err == nil {
+		t.Errorf("expected an invalid payload ID to fail")
+	}
+
+	for _, id := range []string{"../../escaped", "ABCDEF0123456789ABCDEF0123456789", "abc"} {
+		if err := s.Invalidate(id); err == nil {
+			t.Errorf("expected invalid ID to fail, id: %s", id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); err == nil {
+		t.Errorf("file written outside of the store")
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	dir := t.TempDir()
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 200})
+	m := mkdag.GenerateMerkleDAG(d, nil, nil)
+
+	s, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(m); err != nil {
+		t.Fatal(err)
+	}
+
+	source, ok := m.MerkleGraph.Get(m.Sources[0].MerkleID)
+	if !ok || len(source) == 0 {
+		t.Fatalf("expected a source with children")
+	}
+	child := source[0]
+	invalidated := []string{m.Sources[0].PayloadID, child.MerkleID}
+	for _, id := range invalidated {
+		if err := s.Invalidate(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// head.json still references them, they are left out as missing
+	v, missing, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range invalidated {
+		if !slices.Contains(missing, id) {
+			t.Errorf("expected %s to be missing, missing: %v", id, missing)
+		}
+	}
+	if v.PayloadMap.Has(m.Sources[0].PayloadID) || v.MerkleGraph.Has(child.MerkleID) {
+		t.Errorf("missing entries loaded")
+	}
+
+	if err := s.Save(m); err != nil {
+		t.Fatal(err)
+	}
+	v, missing, err = s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) > 0 {
+		t.Errorf("expected no missing entries after Save, missing: %v", missing)
+	}
+	if !dag.IsEquals(d, v.ToDAG()) {
+		t.Errorf("loaded DAG is not equal after invalidate")
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	dir := t.TempDir()
+
+	d := dag.GenerateRandomDAG(&dag.DAGConfig{NumNodes: 200})
+	m := mkdag.GenerateMerkleDAG(d, nil, nil)
+
+	s, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files still there but not matching their ID
+	source := m.Sources[0]
+	corrupt := map[string]string{
+		filepath.Join("payloads", "*", source.PayloadID): "dGFtcGVyZWQ=",
+		filepath.Join("graph", "*", source.MerkleID):     "[]",
+	}
+	for pattern, content := range corrupt {
+		paths, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil || len(paths) != 1 {
+			t.Fatalf("expected one file for %s, found: %v", pattern, paths)
+		}
+		if err := os.WriteFile(paths[0], []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err = store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, missing, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{source.PayloadID, source.MerkleID} {
+		if !slices.Contains(missing, id) {
+			t.Errorf("expected %s to be missing, missing: %v", id, missing)
+		}
+	}
+	if v.PayloadMap.Has(source.PayloadID) || v.MerkleGraph.Has(source.MerkleID) {
+		t.Errorf("corrupt entries loaded")
+	}
+
+	// Written again by the next Save
+	if err := s.Save(m); err != nil {
+		t.Fatal(err)
+	}
+	v, missing, err = s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) > 0 {
+		t.Errorf("expected no missing entries after Save, missing: %v", missing)
+	}
+	if !dag.IsEquals(d, v.ToDAG()) {
+		t.Errorf("loaded DAG is not equal after Save")
+	}
+}
+
+func TestLoadEmpty(t *testing.T) {
+	s, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, _, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != nil {
+		t.Errorf("expected no MerkleDAG")
+	}
+}
@@ -0,0 +1,285 @@
+package utils
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"slices"
+	"sync/atomic"
+)
+
+const (
+	mapBits = 5
+	mapMask = 1<<mapBits - 1
+)
+
+var mapSeed = maphash.MakeSeed()
+
+// Map is a hash map with string keys whose Clone is O(1): the clone and the
+// original share every entry, and a Set or Delete on either only copies the
+// path to the changed entry. The zero value is an empty map ready to use.
+//
+// Like a Go map, a Map must not be read while it is changed, Clone counts as
+// a read. Copies of a Map value refer to the same map once it has been
+// written to.
+type Map[K ~string, V any] struct {
+	t *mapTree[K, V]
+}
+
+type mapTree[K ~string, V any] struct {
+	root *mapNode[K, V]
+	size int
+	// Nodes with this owner are only reachable from this map and are changed
+	// in place, reset by Clone
+	owner atomic.Pointer[mapOwner]
+}
+
+type mapOwner struct{ _ byte }
+
+// A node of the hash trie, with a slot per set bit of bitmap. Below the last
+// level the bitmap is unused and the slots are keys with the same hash.
+type mapNode[K ~string, V any] struct {
+	owner  *mapOwner
+	bitmap uint32
+	slots  []mapSlot[K, V]
+}
+
+// A slot holds either a child or an entry.
+type mapSlot[K ~string, V any] struct {
+	child *mapNode[K, V]
+	hash  uint64
+	key   K
+	value V
+}
+
+func mapHash[K ~string](key K) uint64 {
+	return maphash.String(mapSeed, string(key))
+}
+
+func (n *mapNode[K, V]) index(hash uint64, shift uint) (bit uint32, i int) {
+	bit = 1 << (hash >> shift & mapMask)
+	return bit, bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+// Returns n if owned, a copy owned by owner otherwise.
+func (n *mapNode[K, V]) edit(owner *mapOwner) *mapNode[K, V] {
+	if n.owner == owner {
+		return n
+	}
+	return &mapNode[K, V]{
+		owner:  owner,
+		bitmap: n.bitmap,
+		slots:  slices.Clone(n.slots),
+	}
+}
+
+func (n *mapNode[K, V]) get(hash uint64, shift uint, key K) (v V, ok bool) {
+	for {
+		if shift >= 64 {
+			for _, s := range n.slots {
+				if s.key == key {
+					return s.value, true
+				}
+			}
+			return
+		}
+
+		bit, i := n.index(hash, shift)
+		if n.bitmap&bit == 0 {
+			return
+		}
+		s := &n.slots[i]
+		if s.child == nil {
+			if s.key == key {
+				return s.value, true
+			}
+			return
+		}
+		n, shift = s.child, shift+mapBits
+	}
+}
+
+func (n *mapNode[K, V]) set(owner *mapOwner, hash uint64, shift uint, key K, value V) (*mapNode[K, V], bool) {
+	if shift >= 64 {
+		for i, s := range n.slots {
+			if s.key == key {
+				n = n.edit(owner)
+				n.slots[i].value = value
+				return n, false
+			}
+		}
+		n = n.edit(owner)
+		n.slots = append(n.slots, mapSlot[K, V]{hash: hash, key: key, value: value})
+		return n, true
+	}
+
+	bit, i := n.index(hash, shift)
+	if n.bitmap&bit == 0 {
+		n = n.edit(owner)
+		n.bitmap |= bit
+		n.slots = slices.Insert(n.slots, i, mapSlot[K, V]{hash: hash, key: key, value: value})
+		return n, true
+	}
+
+	s := n.slots[i]
+	switch {
+	case s.child != nil:
+		child, added := s.child.set(owner, hash, shift+mapBits, key, value)
+		n = n.edit(owner)
+		n.slots[i].child = child
+		return n, added
+	case s.key == key:
+		n = n.edit(owner)
+		n.slots[i].value = value
+		return n, false
+	default:
+		// Push both entries one level down
+		child := &mapNode[K, V]{owner: owner}
+		child, _ = child.set(owner, s.hash, shift+mapBits, s.key, s.value)
+		child, _ = child.set(owner, hash, shift+mapBits, key, value)
+		n = n.edit(owner)
+		n.slots[i] = mapSlot[K, V]{child: child}
+		return n, true
+	}
+}
+
+func (n *mapNode[K, V]) delete(owner *mapOwner, hash uint64, shift uint, key K) (*mapNode[K, V], bool) {
+	if shift >= 64 {
+		for i, s := range n.slots {
+			if s.key == key {
+				n = n.edit(owner)
+				n.slots = slices.Delete(n.slots, i, i+1)
+				return n, true
+			}
+		}
+		return n, false
+	}
+
+	bit, i := n.index(hash, shift)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+
+	s := n.slots[i]
+	if s.child == nil {
+		if s.key != key {
+			return n, false
+		}
+		n = n.edit(owner)
+		n.bitmap &^= bit
+		n.slots = slices.Delete(n.slots, i, i+1)
+		return n, true
+	}
+
+	child, removed := s.child.delete(owner, hash, shift+mapBits, key)
+	if !removed {
+		return n, false
+	}
+	n = n.edit(owner)
+	switch {
+	case len(child.slots) == 0:
+		n.bitmap &^= bit
+		n.slots = slices.Delete(n.slots, i, i+1)
+	case len(child.slots) == 1 && child.slots[0].child == nil:
+		// Pull a single entry back up
+		n.slots[i] = child.slots[0]
+	default:
+		n.slots[i].child = child
+	}
+	return n, true
+}
+
+func (n *mapNode[K, V]) each(f func(K, V) bool) bool {
+	for _, s := range n.slots {
+		if s.child != nil {
+			if !s.child.each(f) {
+				return false
+			}
+			continue
+		}
+		if !f(s.key, s.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the value of key, ok is false if there is none.
+func (m Map[K, V]) Get(key K) (v V, ok bool) {
+	if m.t == nil || m.t.root == nil {
+		return
+	}
+	return m.t.root.get(mapHash(key), 0, key)
+}
+
+// Has is true if key is in the map.
+func (m Map[K, V]) Has(key K) bool {
+	_, ok := m.Get(key)
+	return ok
+}
+
+func (m Map[K, V]) Len() int {
+	if m.t == nil {
+		return 0
+	}
+	return m.t.size
+}
+
+func (m *Map[K, V]) owner() *mapOwner {
+	if m.t == nil {
+		m.t = &mapTree[K, V]{}
+	}
+	owner := m.t.owner.Load()
+	if owner == nil {
+		owner = &mapOwner{}
+		m.t.owner.Store(owner)
+	}
+	return owner
+}
+
+func (m *Map[K, V]) Set(key K, value V) {
+	owner := m.owner()
+	root := m.t.root
+	if root == nil {
+		root = &mapNode[K, V]{owner: owner}
+	}
+
+	root, added := root.set(owner, mapHash(key), 0, key, value)
+	m.t.root = root
+	if added {
+		m.t.size++
+	}
+}
+
+func (m *Map[K, V]) Delete(key K) {
+	if m.t == nil || m.t.root == nil {
+		return
+	}
+
+	root, removed := m.t.root.delete(m.owner(), mapHash(key), 0, key)
+	m.t.root = root
+	if removed {
+		m.t.size--
+	}
+}
+
+// Range calls f for every entry in no particular order, until f returns
+// false.
+func (m Map[K, V]) Range(f func(K, V) bool) {
+	if m.t == nil || m.t.root == nil {
+		return
+	}
+	m.t.root.each(f)
+}
+
+// Clone returns a copy of the map in O(1).
+func (m Map[K, V]) Clone() Map[K, V] {
+	if m.t == nil {
+		return Map[K, V]{}
+	}
+
+	// Neither map may change the shared nodes in place anymore
+	if m.t.owner.Load() != nil {
+		m.t.owner.Store(nil)
+	}
+	return Map[K, V]{t: &mapTree[K, V]{root: m.t.root, size: m.t.size}}
+}
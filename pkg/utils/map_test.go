@@ -0,0 +1,68 @@
+package utils_test
+
+import (
+	"dag-poll/pkg/utils"
+	"fmt"
+	"testing"
+)
+
+func TestMap(t *testing.T) {
+	var m utils.Map[string, int]
+	expected := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprint(i)
+		m.Set(key, i)
+		expected[key] = i
+	}
+
+	clone := m.Clone()
+	for i := 0; i < 10000; i += 2 {
+		key := fmt.Sprint(i)
+		m.Delete(key)
+		delete(expected, key)
+	}
+	for i := 1; i < 10000; i += 3 {
+		key := fmt.Sprint(i)
+		m.Set(key, -i)
+		expected[key] = -i
+	}
+	m.Set("new", 1)
+	expected["new"] = 1
+
+	check := func(name string, m utils.Map[string, int], expected map[string]int) {
+		if m.Len() != len(expected) {
+			t.Fatalf("%s: len not match, expected: %d, actual: %d", name, len(expected), m.Len())
+		}
+		for key, value := range expected {
+			if v, ok := m.Get(key); !ok || v != value {
+				t.Fatalf("%s: %s not match, expected: %d, actual: %d", name, key, value, v)
+			}
+		}
+		n := 0
+		m.Range(func(key string, value int) bool {
+			n++
+			if expected[key] != value {
+				t.Fatalf("%s: range %s not match, expected: %d, actual: %d", name, key, expected[key], value)
+			}
+			return true
+		})
+		if n != len(expected) {
+			t.Fatalf("%s: range count not match, expected: %d, actual: %d", name, len(expected), n)
+		}
+	}
+
+	check("map", m, expected)
+
+	// The clone is left as it was
+	original := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		original[fmt.Sprint(i)] = i
+	}
+	check("clone", clone, original)
+
+	for key := range expected {
+		m.Delete(key)
+	}
+	check("empty", m, nil)
+	check("clone", clone, original)
+}
@@ -1,9 +1,7 @@
 package utils
 
 import (
-	"crypto/md5"
 	"dag-poll/pkg/dag"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -89,11 +87,3 @@ func (s Set[T]) ToSlice() []T {
 	}
 	return r
 }
-
-func GenerateMD5(list []string) string {
-	hasher := md5.New()
-	for _, v := range list {
-		hasher.Write([]byte(v))
-	}
-	return hex.EncodeToString(hasher.Sum(nil))
-}
@@ -2,9 +2,9 @@
 
 case "$1" in
     "observable")
-        go run observable/main.go
+        go run ./observable "${@:2}"
     ;;
 
     "observer")
-        go run observer/*.go
-esac
\ No newline at end of file
+        go run ./observer "${@:2}"
+esac